@@ -1,5 +1,11 @@
 package amf
 
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
 const (
 	TYPE_NUMBER      = 0x00
 	TYPE_BOOL        = 0x01
@@ -35,3 +41,157 @@ func (cxt *Decoder) ReadVal() interface{} {
 	}
 	return nil
 }
+
+// WriteValueAmf0 writes an AMF0 value. Maps and structs are written as anonymous
+// objects, slices and arrays as strict arrays.
+func (cxt *Encoder) WriteValueAmf0(value interface{}) error {
+	if value == nil {
+		return cxt.writeByte(amf0_nullType)
+	}
+
+	if raw, ok := rawValueOf(value); ok {
+		return cxt.WriteRawValue(raw)
+	}
+
+	return cxt.writeReflectedValueAmf0(reflect.ValueOf(value))
+}
+
+func (cxt *Encoder) writeReflectedValueAmf0(value reflect.Value) error {
+	if handled, err := cxt.writeMarshaler(value, 0); handled {
+		return err
+	}
+
+	if identity := identityOf(value); identity != nil {
+		if cxt.amf0Open[identity] {
+			return errors.New(fmt.Sprintf("cannot write cyclic %v in AMF0", value.Type()))
+		}
+		if cxt.amf0Open == nil {
+			cxt.amf0Open = make(map[interface{}]bool)
+		}
+		cxt.amf0Open[identity] = true
+		defer delete(cxt.amf0Open, identity)
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		str := value.String()
+		if len(str) > 0xffff {
+			cxt.writeByte(amf0_longStringType)
+			cxt.WriteUint32(uint32(len(str)))
+			_, err := cxt.stream.Write([]byte(str))
+			return err
+		}
+		cxt.writeByte(amf0_stringType)
+		return cxt.WriteString(str)
+	case reflect.Bool:
+		cxt.writeByte(amf0_booleanType)
+		if value.Bool() {
+			return cxt.writeByte(0x01)
+		}
+		return cxt.writeByte(0x00)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		cxt.writeByte(amf0_numberType)
+		return cxt.WriteFloat64(float64(value.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		cxt.writeByte(amf0_numberType)
+		return cxt.WriteFloat64(float64(value.Uint()))
+	case reflect.Float32, reflect.Float64:
+		cxt.writeByte(amf0_numberType)
+		return cxt.WriteFloat64(value.Float())
+	case reflect.Array, reflect.Slice:
+		cxt.writeByte(amf0_strictArrayType)
+		cxt.WriteUint32(uint32(value.Len()))
+		for i := 0; i < value.Len(); i++ {
+			if err := cxt.writeReflectedValueAmf0(value.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		cxt.writeByte(amf0_objectType)
+		entries, err := sortedMapEntries(value)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			cxt.WriteString(entry.key)
+			if err := cxt.writeReflectedValueAmf0(entry.value); err != nil {
+				return err
+			}
+		}
+		return cxt.writeObjectEndAmf0()
+	case reflect.Struct:
+		cxt.writeByte(amf0_objectType)
+		info := structInfoOf(value.Type())
+		for _, field := range info.fields {
+			cxt.WriteString(field.name)
+			if err := cxt.writeReflectedValueAmf0(value.Field(field.index)); err != nil {
+				return err
+			}
+		}
+		extra, err := info.extraFields(value)
+		if err != nil {
+			return err
+		}
+		for _, entry := range extra {
+			cxt.WriteString(entry.key)
+			if err := cxt.writeReflectedValueAmf0(entry.value); err != nil {
+				return err
+			}
+		}
+		return cxt.writeObjectEndAmf0()
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return cxt.writeByte(amf0_nullType)
+		}
+		return cxt.writeReflectedValueAmf0(value.Elem())
+	}
+
+	return errors.New(fmt.Sprintf("writeReflectedValueAmf0 doesn't support kind: %v",
+		value.Kind().String()))
+}
+
+// An object ends with an empty name followed by the object end marker.
+func (cxt *Encoder) writeObjectEndAmf0() error {
+	cxt.WriteUint16(0)
+	return cxt.writeByte(amf0_objectEndType)
+}
+
+// Read the name-value pairs of an AMF0 object, up to and including the object end
+// marker. Names are returned in stream order.
+func (cxt *Decoder) readObjectPropertiesAmf0() ([]string, map[string]interface{}) {
+	names := []string{}
+	result := make(map[string]interface{})
+	for !cxt.errored() {
+		_, name := cxt.ReadString()
+		if name == "" {
+			if marker := cxt.ReadByte(); marker != amf0_objectEndType && !cxt.errored() {
+				cxt.saveError(errors.New(fmt.Sprintf("Expected AMF0 object end, found %d", marker)))
+			}
+			break
+		}
+		names = append(names, name)
+		result[name] = cxt.readValueAmf0()
+	}
+	return names, result
+}
+
+// Read an AMF0 typed object. Registered types are decoded like AMF3 objects of
+// the same class.
+func (cxt *Decoder) readTypedObjectAmf0() interface{} {
+	_, className := cxt.ReadString()
+	names, fields := cxt.readObjectPropertiesAmf0()
+	if cxt.errored() {
+		return nil
+	}
+
+	object := AvmObject{}
+	object.Class = &AvmClass{Name: className, Properties: names}
+	object.StaticFields = fields
+	object.DynamicFields = make(map[string]interface{})
+
+	if result, ok := cxt.applyRegisteredType(object); ok {
+		return result
+	}
+	return object
+}
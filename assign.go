@@ -0,0 +1,357 @@
+package amf
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// assignValue stores a decoded value into dst, converting it to the type of dst:
+// numbers to any numeric type that can hold them, arrays to slices, objects and
+// maps to structs and maps, and so on. Values that don't fit are reported as
+// errors.
+//
+// Decoded objects can refer to themselves. Such cycles are rebuilt as pointer
+// cycles; cycles that go through no pointer are reported as errors.
+func assignValue(dst reflect.Value, src interface{}) error {
+	return (&assigner{}).assign(dst, src)
+}
+
+// assigner holds the state of an assignValue call, which tracks the decoded
+// containers being assigned.
+type assigner struct {
+	// Pointers to the values built from containers, by container and pointer
+	// type.
+	pointers map[assignKey]reflect.Value
+
+	// Containers being assigned, by container and destination type.
+	active map[assignKey]bool
+
+	// If set, struct members that can't be assigned are left to their zero
+	// value, and their errors kept in skipped.
+	skipMemberErrors bool
+	skipped          []error
+}
+
+type assignKey struct {
+	source uintptr
+	typ    reflect.Type
+}
+
+func (a *assigner) assign(dst reflect.Value, src interface{}) error {
+	if dst.CanAddr() && reflect.PtrTo(dst.Type()).Implements(valueUnmarshalerType) {
+		return dst.Addr().Interface().(ValueUnmarshaler).UnmarshalAMFValue(src)
+	}
+
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	value := reflect.ValueOf(src)
+	if value.Type().AssignableTo(dst.Type()) {
+		dst.Set(value)
+		return nil
+	}
+
+	// Strings are the text form of encoding.TextUnmarshaler implementations.
+	if text, ok := src.(string); ok && dst.CanAddr() &&
+		reflect.PtrTo(dst.Type()).Implements(textUnmarshalerType) {
+		return dst.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+	}
+
+	// Decoded dates are time.Time values, assigned above. Numbers are not taken
+	// as dates.
+	if dst.Type() == timeType {
+		return errors.New(fmt.Sprintf("cannot assign %v to %v", value.Type(), dst.Type()))
+	}
+
+	source := containerIdentity(src)
+	if source != 0 {
+		switch dst.Kind() {
+		case reflect.Ptr:
+			// A container met again inside itself gets the pointer built for it.
+			if built, ok := a.pointers[assignKey{source, dst.Type()}]; ok {
+				dst.Set(built)
+				return nil
+			}
+		case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct:
+			key := assignKey{source, dst.Type()}
+			if a.active[key] {
+				return errors.New(fmt.Sprintf("cannot assign cyclic %T to %v", src, dst.Type()))
+			}
+			if a.active == nil {
+				a.active = make(map[assignKey]bool)
+				a.pointers = make(map[assignKey]reflect.Value)
+			}
+			a.active[key] = true
+			defer delete(a.active, key)
+			if dst.CanAddr() {
+				a.pointers[assignKey{source, reflect.PtrTo(dst.Type())}] = dst.Addr()
+			}
+		}
+	}
+
+	switch dst.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(dst.Type().Elem())
+		if err := a.assign(elem.Elem(), src); err != nil {
+			return err
+		}
+		dst.Set(elem)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return assignNumber(dst, value)
+	case reflect.Bool:
+		if value.Kind() == reflect.Bool {
+			dst.SetBool(value.Bool())
+			return nil
+		}
+	case reflect.String:
+		if value.Kind() == reflect.String {
+			dst.SetString(value.String())
+			return nil
+		}
+	case reflect.Slice, reflect.Array:
+		if elements, ok := arrayElements(src); ok {
+			return a.assignArray(dst, elements)
+		}
+	case reflect.Map:
+		if fields, ok := objectFields(src); ok {
+			return a.assignMap(dst, fields)
+		}
+	case reflect.Struct:
+		if fields, ok := objectFields(src); ok {
+			return a.assignStruct(dst, fields)
+		}
+	}
+
+	return errors.New(fmt.Sprintf("cannot assign %T to %v", src, dst.Type()))
+}
+
+// assignNumber stores a number into a numeric dst, failing if it doesn't fit.
+func assignNumber(dst reflect.Value, value reflect.Value) error {
+	var f float64
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f = float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f = float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		f = value.Float()
+	default:
+		return errors.New(fmt.Sprintf("cannot assign %v to %v", value.Type(), dst.Type()))
+	}
+
+	switch dst.Kind() {
+	case reflect.Float32, reflect.Float64:
+		dst.SetFloat(f)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if value.Kind() >= reflect.Int && value.Kind() <= reflect.Int64 {
+			if !dst.OverflowInt(value.Int()) {
+				dst.SetInt(value.Int())
+				return nil
+			}
+		} else if value.Kind() >= reflect.Uint && value.Kind() <= reflect.Uint64 {
+			if value.Uint() <= math.MaxInt64 && !dst.OverflowInt(int64(value.Uint())) {
+				dst.SetInt(int64(value.Uint()))
+				return nil
+			}
+		} else if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 &&
+			!dst.OverflowInt(int64(f)) {
+			dst.SetInt(int64(f))
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if value.Kind() >= reflect.Uint && value.Kind() <= reflect.Uint64 {
+			if !dst.OverflowUint(value.Uint()) {
+				dst.SetUint(value.Uint())
+				return nil
+			}
+		} else if f == math.Trunc(f) && f >= 0 && f < math.MaxUint64 &&
+			!dst.OverflowUint(uint64(f)) {
+			dst.SetUint(uint64(f))
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("%v does not fit in %v", value.Interface(), dst.Type()))
+}
+
+// containerIdentity returns what identifies a decoded array or object, which
+// references share, or 0 for other values.
+func containerIdentity(src interface{}) uintptr {
+	switch v := src.(type) {
+	case map[string]interface{}:
+		return reflect.ValueOf(v).Pointer()
+	case []interface{}:
+		if len(v) > 0 {
+			return reflect.ValueOf(v).Pointer()
+		}
+	case *AvmArray:
+		return reflect.ValueOf(v).Pointer()
+	case AvmArray:
+		if len(v.Elements) > 0 {
+			return reflect.ValueOf(v.Elements).Pointer()
+		}
+		return reflect.ValueOf(v.Fields).Pointer()
+	case AvmObject:
+		return reflect.ValueOf(v.StaticFields).Pointer()
+	}
+	return 0
+}
+
+// arrayElements returns the dense elements of a decoded array.
+func arrayElements(src interface{}) ([]interface{}, bool) {
+	switch v := src.(type) {
+	case []interface{}:
+		return v, true
+	case AvmArray:
+		return v.Elements, true
+	case *AvmArray:
+		return v.Elements, true
+	}
+	return nil, false
+}
+
+// objectFields returns the members of a decoded object.
+func objectFields(src interface{}) (map[string]interface{}, bool) {
+	switch v := src.(type) {
+	case map[string]interface{}:
+		return v, true
+	case AvmObject:
+		fields := make(map[string]interface{}, len(v.StaticFields)+len(v.DynamicFields))
+		for name, field := range v.DynamicFields {
+			fields[name] = field
+		}
+		for name, field := range v.StaticFields {
+			fields[name] = field
+		}
+		return fields, true
+	case AvmArray:
+		return v.Fields, true
+	case *AvmArray:
+		return v.Fields, true
+	}
+	return nil, false
+}
+
+func (a *assigner) assignArray(dst reflect.Value, elements []interface{}) error {
+	if dst.Kind() == reflect.Array {
+		if len(elements) != dst.Len() {
+			return errors.New(fmt.Sprintf("cannot assign %d elements to %v",
+				len(elements), dst.Type()))
+		}
+	} else {
+		dst.Set(reflect.MakeSlice(dst.Type(), len(elements), len(elements)))
+	}
+
+	for i, element := range elements {
+		if err := a.assign(dst.Index(i), element); err != nil {
+			return errors.New(fmt.Sprintf("element %d: %v", i, err))
+		}
+	}
+	return nil
+}
+
+// assignStruct fills a struct from decoded members, as described by structInfo.
+// Members that match no field are stored in the ",extra" field, or dropped if
+// there is none.
+func (a *assigner) assignStruct(dst reflect.Value, fields map[string]interface{}) error {
+	info := structInfoOf(dst.Type())
+
+	var extra reflect.Value
+	if info.extra >= 0 {
+		extra = dst.Field(info.extra)
+	}
+
+	for name, value := range fields {
+		field, ok := info.field(name)
+		if !ok {
+			if extra.IsValid() {
+				if extra.IsNil() {
+					extra.Set(reflect.MakeMap(extra.Type()))
+				}
+				elem := reflect.New(extra.Type().Elem()).Elem()
+				if err := a.assign(elem, value); err != nil {
+					return errors.New(fmt.Sprintf("%s: %v", name, err))
+				}
+				extra.SetMapIndex(reflect.ValueOf(name).Convert(extra.Type().Key()), elem)
+			}
+			continue
+		}
+		if err := a.assign(dst.Field(field.index), value); err != nil {
+			err = errors.New(fmt.Sprintf("%s: %v", name, err))
+			if !a.skipMemberErrors {
+				return err
+			}
+			dst.Field(field.index).Set(reflect.Zero(dst.Field(field.index).Type()))
+			a.skipped = append(a.skipped, err)
+		}
+	}
+	return nil
+}
+
+// assignMap fills a Go map from decoded members, converting member names back
+// into keys the way mapKeyString formats them.
+func (a *assigner) assignMap(dst reflect.Value, fields map[string]interface{}) error {
+	result := reflect.MakeMapWithSize(dst.Type(), len(fields))
+	for name, field := range fields {
+		key := reflect.New(dst.Type().Key()).Elem()
+		if err := assignMapKey(key, name); err != nil {
+			return err
+		}
+		elem := reflect.New(dst.Type().Elem()).Elem()
+		if err := a.assign(elem, field); err != nil {
+			return err
+		}
+		result.SetMapIndex(key, elem)
+	}
+	dst.Set(result)
+	return nil
+}
+
+func assignMapKey(key reflect.Value, name string) error {
+	if key.Kind() == reflect.String {
+		key.SetString(name)
+		return nil
+	}
+	if reflect.PtrTo(key.Type()).Implements(textUnmarshalerType) {
+		return key.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(name))
+	}
+
+	switch key.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(name, 10, key.Type().Bits())
+		if err != nil {
+			return err
+		}
+		key.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(name, 10, key.Type().Bits())
+		if err != nil {
+			return err
+		}
+		key.SetUint(n)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(name, key.Type().Bits())
+		if err != nil {
+			return err
+		}
+		key.SetFloat(n)
+		return nil
+	case reflect.Interface:
+		key.Set(reflect.ValueOf(name))
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("unsupported map key type: %v", key.Type()))
+}
@@ -0,0 +1,172 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testUser struct {
+	ID     int `amf:"id"`
+	Name   string
+	Tags   []string
+	Score  float32
+	Level  int8
+	Parent *testUser
+	Born   time.Time
+	Counts map[string]uint
+	Cache  string                 `amf:"-"`
+	Extra  map[string]interface{} `amf:",extra"`
+}
+
+func TestAssignRegisteredType(t *testing.T) {
+	class := &AvmClass{Name: "User", Dynamic: true,
+		Properties: []string{"id", "name", "tags", "score", "parent", "born", "counts"}}
+	parent := AvmObject{Class: class, StaticFields: map[string]interface{}{"id": 1}}
+	user := AvmObject{
+		Class: class,
+		StaticFields: map[string]interface{}{
+			"id":     7,
+			"name":   "Sam",
+			"tags":   []interface{}{"a", "b"},
+			"score":  1.5,
+			"parent": parent,
+			"born":   time.Unix(1000, 0),
+			"counts": map[string]interface{}{"x": 3},
+		},
+		DynamicFields: map[string]interface{}{"nick": "sammy", "cache": "no"},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := WriteValueAmf3(buf, user); err != nil {
+		t.Fatalf("Received error while writing object: %v", err)
+	}
+
+	cxt := NewDecoder(buf, 3)
+	cxt.RegisterType("User", testUser{})
+	value := cxt.ReadValueAmf3()
+	if cxt.decodeError != nil {
+		t.Fatalf("Received error while reading object: %v", cxt.decodeError)
+	}
+
+	result, ok := value.(testUser)
+	if !ok {
+		t.Fatalf("Expected a testUser, got %T", value)
+	}
+	if result.ID != 7 || result.Name != "Sam" || result.Score != 1.5 {
+		t.Errorf("Wrong scalar fields: %+v", result)
+	}
+	if len(result.Tags) != 2 || result.Tags[1] != "b" {
+		t.Errorf("Wrong slice field: %v", result.Tags)
+	}
+	if result.Parent == nil || result.Parent.ID != 1 {
+		t.Errorf("Wrong nested object: %v", result.Parent)
+	}
+	if !result.Born.Equal(time.Unix(1000, 0)) {
+		t.Errorf("Wrong date: %v", result.Born)
+	}
+	if result.Counts["x"] != 3 {
+		t.Errorf("Wrong map field: %v", result.Counts)
+	}
+	if result.Cache != "" || result.Extra["nick"] != "sammy" || result.Extra["cache"] != "no" {
+		t.Errorf("Wrong unknown members: %q, %v", result.Cache, result.Extra)
+	}
+}
+
+func TestAssignErrors(t *testing.T) {
+	var user testUser
+	dst := reflect.ValueOf(&user).Elem()
+	if err := assignValue(dst, map[string]interface{}{"id": "7"}); err == nil {
+		t.Errorf("Expected an error assigning a string to an int field")
+	}
+	if err := assignValue(dst, map[string]interface{}{"level": 300}); err == nil {
+		t.Errorf("Expected an error assigning 300 to an int8 field")
+	}
+	if err := assignValue(dst, map[string]interface{}{"id": 1.5}); err == nil {
+		t.Errorf("Expected an error assigning 1.5 to an int field")
+	}
+	if err := assignValue(dst, map[string]interface{}{"tags": []interface{}{1}}); err == nil {
+		t.Errorf("Expected an error assigning a number to a string element")
+	}
+
+	if err := assignValue(dst, map[string]interface{}{"counts": map[string]interface{}{
+		"x": int32(-1)}}); err == nil {
+		t.Errorf("Expected an error assigning -1 to a uint")
+	}
+	if err := assignValue(dst, map[string]interface{}{"born": int32(1000)}); err == nil {
+		t.Errorf("Expected an error assigning an integer to a date")
+	}
+
+	// nil clears fields.
+	user.Name = "Sam"
+	if err := assignValue(dst, map[string]interface{}{"name": nil}); err != nil ||
+		user.Name != "" {
+		t.Errorf("Assigning nil returned %q, %v", user.Name, err)
+	}
+}
+
+func TestAssignNegativeNumbers(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for _, value := range []interface{}{-1, -268435456, int8(-5), -1.5} {
+		if err := WriteValueAmf3(buf, value); err != nil {
+			t.Fatalf("Received error while writing %v: %v", value, err)
+		}
+	}
+
+	cxt := NewDecoder(buf, 3)
+	var n int
+	if err := cxt.Decode(&n); err != nil || n != -1 {
+		t.Errorf("Decode into int returned %d, %v", n, err)
+	}
+	var n32 int32
+	if err := cxt.Decode(&n32); err != nil || n32 != -268435456 {
+		t.Errorf("Decode into int32 returned %d, %v", n32, err)
+	}
+	var user testUser
+	if err := cxt.Decode(&user.Level); err != nil || user.Level != -5 {
+		t.Errorf("Decode into int8 returned %d, %v", user.Level, err)
+	}
+	var f float64
+	if err := cxt.Decode(&f); err != nil || f != -1.5 {
+		t.Errorf("Decode into float64 returned %v, %v", f, err)
+	}
+}
+
+type testNode struct {
+	Name string
+	Next *testNode
+}
+
+type testLoop struct {
+	Next []testLoop
+}
+
+func TestAssignCycles(t *testing.T) {
+	// An object whose next member is the object itself.
+	blob, _ := hex.DecodeString("0a0b01096e616d65060361096e6578740a0001")
+
+	var node testNode
+	if err := NewDecoder(bytes.NewBuffer(blob), 3).Decode(&node); err != nil {
+		t.Fatalf("Decode returned error: %v", err)
+	}
+	if node.Name != "a" || node.Next != &node {
+		t.Errorf("The cycle wasn't rebuilt: %+v", node)
+	}
+
+	var pointer *testNode
+	if err := NewDecoder(bytes.NewBuffer(blob), 3).Decode(&pointer); err != nil {
+		t.Fatalf("Decode returned error: %v", err)
+	}
+	if pointer == nil || pointer.Next != pointer {
+		t.Errorf("The cycle wasn't rebuilt: %+v", pointer)
+	}
+
+	// Cycles without pointers can't be rebuilt.
+	blob, _ = hex.DecodeString("0a0b01096e6578740903010a0001")
+	var loop testLoop
+	if err := NewDecoder(bytes.NewBuffer(blob), 3).Decode(&loop); err == nil {
+		t.Errorf("Expected an error for a cycle without pointers")
+	}
+}
@@ -0,0 +1,133 @@
+package amf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Batch collects calls to send in one HTTP request, as Flex does for calls made
+// in the same frame.
+//
+//	calls, err := client.Batch().
+//		Add("UserService", "find", &user, 7).
+//		Add("OrderService", "list", &orders, 7).
+//		Do(ctx)
+//
+// Each call gets its own result or error: a fault in one call doesn't affect the
+// others.
+type Batch struct {
+	client *Client
+	calls  []*BatchCall
+}
+
+// BatchCall is a call in a batch. Do decodes the result of the call into Result,
+// or sets Err.
+type BatchCall struct {
+	Destination string
+	Operation   string
+	Args        []interface{}
+	Result      interface{}
+	Err         error
+}
+
+// Batch returns an empty batch of calls.
+func (c *Client) Batch() *Batch {
+	return &Batch{client: c}
+}
+
+// Add appends a call to the batch. Its arguments and result are as for Call.
+func (b *Batch) Add(destination, operation string, result interface{}, args ...interface{}) *Batch {
+	if args == nil {
+		args = []interface{}{}
+	}
+	b.calls = append(b.calls, &BatchCall{
+		Destination: destination,
+		Operation:   operation,
+		Args:        args,
+		Result:      result,
+	})
+	return b
+}
+
+// Do sends the calls, and returns them with their results or errors set. The
+// error returned is for the request as a whole, such as a transport error.
+//
+// Replies are matched with their calls by response URI, /1 for the first call,
+// /2 for the second... A call that gets no reply fails. Calls rejected because
+// of the session, or because the user logged in with Login is no longer known,
+// are sent again once, after a new handshake and login.
+func (b *Batch) Do(ctx context.Context) ([]*BatchCall, error) {
+	if len(b.calls) == 0 {
+		return b.calls, nil
+	}
+
+	if err := b.send(ctx, b.calls); err != nil {
+		return b.calls, err
+	}
+
+	loggedIn := b.client.loggedIn()
+	var rejected []*BatchCall
+	for _, call := range b.calls {
+		if isSessionFault(call.Err) || (loggedIn && isAuthenticationFault(call.Err)) {
+			rejected = append(rejected, call)
+		}
+	}
+	if len(rejected) > 0 {
+		b.client.resetSession()
+		if err := b.send(ctx, rejected); err != nil {
+			return b.calls, err
+		}
+	}
+	return b.calls, nil
+}
+
+func (b *Batch) send(ctx context.Context, calls []*BatchCall) error {
+	if err := b.client.connect(ctx); err != nil {
+		return err
+	}
+
+	messages := make([]AmfMessage, len(calls))
+	idempotent := true
+	for i, call := range calls {
+		messages[i] = b.client.newRemotingMessage(i+1, call.Destination, call.Operation, call.Args)
+		idempotent = idempotent && b.client.Retry.idempotent(call.Destination, call.Operation)
+	}
+
+	b.client.mu.Lock()
+	headers := b.client.envelopeHeaders()
+	b.client.mu.Unlock()
+
+	replies, err := b.client.send(ctx, headers, messages, idempotent)
+	if err != nil {
+		return err
+	}
+
+	answered := make([]bool, len(calls))
+	for _, reply := range replies {
+		index, ok := replyIndex(reply.TargetUri)
+		if !ok || index < 1 || index > len(calls) || answered[index-1] {
+			continue
+		}
+		answered[index-1] = true
+		calls[index-1].Err = decodeReply(reply, calls[index-1].Result)
+	}
+
+	for i, call := range calls {
+		if !answered[i] {
+			call.Err = errors.New(fmt.Sprintf("amf: no reply to %s.%s", call.Destination,
+				call.Operation))
+		}
+	}
+	return nil
+}
+
+// replyIndex returns the number of the response URI a reply is sent to: 2 for
+// /2/onResult.
+func replyIndex(targetUri string) (int, bool) {
+	parts := strings.Split(strings.TrimPrefix(targetUri, "/"), "/")
+	index, err := strconv.Atoi(parts[0])
+	return index, err == nil
+}
@@ -0,0 +1,554 @@
+package amf
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Client calls remote services over AMF, the way a Flex RemoteObject does.
+type Client struct {
+	// URL of the AMF endpoint, such as http://host/app/messagebroker/amf.
+	URL string
+
+	// HTTPClient sends the requests. NewClient sets it to a client with a cookie
+	// jar, so that the session cookie of the server is sent back. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Retry sets how requests are retried after transport errors. They are not
+	// retried if nil.
+	Retry *RetryPolicy
+
+	// Logger receives the request and reply envelopes if debug level is
+	// enabled, and retried errors. Nothing is logged if nil.
+	Logger *slog.Logger
+
+	// Changes to the URL asked for by the server with the AppendToGatewayUrl and
+	// ReplaceGatewayUrl headers.
+	urlMu      sync.Mutex
+	urlSuffix  string
+	replaceURL string
+
+	// Session assigned by the server during the handshake.
+	mu        sync.Mutex
+	connected bool
+	dsID      string
+	clientID  string
+
+	// Credentials sent in the Credentials header.
+	credentials map[string]interface{}
+
+	// Credentials of Login, kept to log in again when the session is lost.
+	login         string
+	authenticated bool
+}
+
+// NewClient returns a client for the AMF endpoint at url.
+func NewClient(url string) *Client {
+	jar, _ := cookiejar.New(nil)
+	return &Client{URL: url, HTTPClient: &http.Client{Jar: jar}}
+}
+
+// Call invokes an operation of a remote destination with the given arguments,
+// and decodes the result into the value pointed to by result (as Decoder.Decode
+// would), unless result is nil. Error replies are returned as *FaultError.
+//
+// ctx bounds the whole call, retries included.
+//
+// The first call performs the channel handshake. If the server no longer knows
+// the session, or no longer knows the user logged in with Login, the handshake
+// and login are done again and the call retried once.
+func (c *Client) Call(ctx context.Context, destination, operation string,
+	result interface{}, args ...interface{}) error {
+
+	calls, err := c.Batch().Add(destination, operation, result, args...).Do(ctx)
+	if err != nil {
+		return err
+	}
+	return calls[0].Err
+}
+
+// DSId returns the id of the session assigned by the server, or "" before the
+// handshake.
+func (c *Client) DSId() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dsID
+}
+
+// SetCredentials makes the client send a Credentials header with every request,
+// which servers use to authenticate each request. Pass empty strings to stop
+// sending it.
+func (c *Client) SetCredentials(username, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.credentials = nil
+	if username != "" || password != "" {
+		c.credentials = map[string]interface{}{"userid": username, "password": password}
+	}
+}
+
+// Login authenticates the session with a LOGIN CommandMessage, as
+// ChannelSet.login does in Flex. The credentials are kept, so that the client can
+// log in again if the server reports a Client.Authentication fault.
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	c.mu.Lock()
+	c.login = base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	c.authenticated = false
+	c.mu.Unlock()
+
+	err := c.connect(ctx)
+	if err != nil {
+		c.mu.Lock()
+		c.login = ""
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// Logout ends the authenticated session with a LOGOUT CommandMessage.
+func (c *Client) Logout(ctx context.Context) error {
+	c.mu.Lock()
+	c.login = ""
+	authenticated := c.authenticated
+	c.authenticated = false
+	c.mu.Unlock()
+
+	if !authenticated {
+		return nil
+	}
+	return c.command(ctx, LOGOUT_OPERATION, map[string]interface{}{})
+}
+
+// connect performs the handshake Flex channels do before their first message: a
+// CLIENT_PING CommandMessage, whose acknowledgement carries the DSId of the
+// session and the client id. Both are sent with every later message. After the
+// handshake, connect logs in if Login was called.
+//
+// c.mu isn't held while the commands are sent, so that a slow server doesn't
+// block the other methods of the client.
+func (c *Client) connect(ctx context.Context) error {
+	c.mu.Lock()
+	connected, login, authenticated := c.connected, c.login, c.authenticated
+	c.mu.Unlock()
+
+	if !connected {
+		if err := c.command(ctx, CLIENT_PING_OPERATION, map[string]interface{}{}); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.connected = true
+		c.mu.Unlock()
+	}
+
+	if login != "" && !authenticated {
+		if err := c.command(ctx, LOGIN_OPERATION, login); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.authenticated = c.login == login
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// command sends a CommandMessage, and keeps the session ids found in the
+// acknowledgement. It must be called without c.mu held.
+func (c *Client) command(ctx context.Context, operation uint32, body interface{}) error {
+	c.mu.Lock()
+	message := AmfMessage{
+		TargetUri:   "null",
+		ResponseUri: "/1",
+		Body: []interface{}{FlexCommandMessage{
+			Body:      body,
+			ClientId:  c.clientID,
+			MessageId: newMessageId(),
+			Headers:   c.messageHeaders(),
+			Operation: operation,
+		}},
+	}
+	headers := c.envelopeHeaders()
+	c.mu.Unlock()
+
+	replies, err := c.send(ctx, headers, []AmfMessage{message}, true)
+	if err != nil {
+		return err
+	}
+	if err := decodeReply(replies[0], nil); err != nil {
+		return err
+	}
+
+	if ack, ok := replies[0].Body.(AvmObject); ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		headers, _ := ack.Get("headers")
+		if headers, ok := headers.(map[string]interface{}); ok {
+			if dsID, ok := headers["DSId"].(string); ok && dsID != "" {
+				c.dsID = dsID
+			}
+		}
+		if clientID, _ := ack.Get("clientId"); clientID != nil {
+			c.clientID, _ = clientID.(string)
+		}
+	}
+	return nil
+}
+
+// messageHeaders returns the headers of the Flex messages sent in the session.
+// It must be called with c.mu held.
+func (c *Client) messageHeaders() map[string]interface{} {
+	dsID := c.dsID
+	if dsID == "" {
+		dsID = "nil"
+	}
+	return map[string]interface{}{"DSId": dsID}
+}
+
+// envelopeHeaders returns the AMF headers of requests. It must be called with
+// c.mu held.
+func (c *Client) envelopeHeaders() []Header {
+	if c.credentials == nil {
+		return nil
+	}
+	return []Header{{Name: "Credentials", Value: c.credentials}}
+}
+
+// resetSession forgets the session, so that the next call does the handshake
+// (and login) again.
+func (c *Client) resetSession() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+	c.authenticated = false
+	c.dsID = ""
+	c.clientID = ""
+}
+
+// isSessionFault reports whether err is a fault saying that the server doesn't
+// accept the session, as BlazeDS does when it detects a duplicate session or
+// doesn't know the DSId.
+func isSessionFault(err error) bool {
+	var fault *FaultError
+	if !errors.As(err, &fault) {
+		return false
+	}
+	return strings.Contains(fault.FaultCode, "DuplicateSession") ||
+		strings.Contains(fault.FaultCode, "InvalidSession") ||
+		strings.Contains(fault.FaultCode, "InvalidFlexClient")
+}
+
+// isAuthenticationFault reports whether err is a fault saying that the user
+// isn't logged in.
+func isAuthenticationFault(err error) bool {
+	var fault *FaultError
+	return errors.As(err, &fault) && fault.FaultCode == "Client.Authentication"
+}
+
+// loggedIn reports whether Login was called, and Logout wasn't.
+func (c *Client) loggedIn() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.login != ""
+}
+
+// newRemotingMessage returns the envelope message for a RemotingMessage. Its
+// reply is sent to the response URI /index.
+func (c *Client) newRemotingMessage(index int, destination, operation string,
+	args []interface{}) AmfMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return AmfMessage{
+		TargetUri:   "null",
+		ResponseUri: fmt.Sprintf("/%d", index),
+		Body: []interface{}{FlexRemotingMessage{
+			ClientId:    c.clientID,
+			MessageId:   newMessageId(),
+			Body:        args,
+			Operation:   operation,
+			Destination: destination,
+			Headers:     c.messageHeaders(),
+		}},
+	}
+}
+
+func newMessageId() string {
+	return strings.ToUpper(uuid.New().String())
+}
+
+// send posts messages in one request, and returns the messages of the reply.
+// Transport errors are retried as set by the retry policy, if the messages may be
+// sent again.
+func (c *Client) send(ctx context.Context, headers []Header, messages []AmfMessage,
+	idempotent bool) ([]AmfMessage, error) {
+
+	bundle := MessageBundle{
+		AmfVersion: 3,
+		Headers:    headers,
+		Messages:   messages,
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	encoder := NewEncoder(buffer)
+	encoder.Logger = c.Logger
+	if err := EncodeMessageBundle(encoder, &bundle); err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		replies, err := c.post(ctx, buffer.Bytes())
+		if err == nil || !idempotent || !c.Retry.retry(ctx, attempt, err) {
+			return replies, err
+		}
+		if c.Logger != nil {
+			c.Logger.WarnContext(ctx, "retrying AMF request", "attempt", attempt, "error", err)
+		}
+	}
+}
+
+// post sends an encoded request, and decodes the reply.
+func (c *Client) post(ctx context.Context, body []byte) ([]AmfMessage, error) {
+	request, err := http.NewRequestWithContext(ctx, "POST", c.gatewayURL(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-amf")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	// Error pages are reported as they are, rather than decoded as AMF.
+	if response.StatusCode != http.StatusOK ||
+		strings.HasPrefix(response.Header.Get("Content-Type"), "text/html") {
+		partial, _ := io.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+		return nil, &HTTPError{
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+			Body:       partial,
+		}
+	}
+
+	reply, err := decodeMessageBundle(response.Body, false, c.Logger)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Messages) == 0 {
+		return nil, errors.New("amf: reply has no messages")
+	}
+	c.applyReplyHeaders(reply.Headers)
+	return reply.Messages, nil
+}
+
+// Number of bytes of an error page kept in HTTPError.
+const maxErrorBody = 512
+
+// HTTPError is returned when the server doesn't reply with AMF, such as when it
+// answers with an error page.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+
+	// Start of the response body.
+	Body []byte
+}
+
+func (e *HTTPError) Error() string {
+	if len(e.Body) == 0 {
+		return fmt.Sprintf("amf: HTTP status %s", e.Status)
+	}
+	return fmt.Sprintf("amf: HTTP status %s: %s", e.Status, e.Body)
+}
+
+// RetryPolicy sets how requests are retried after transport errors: failed
+// connections, and 502, 503 and 504 replies. Faults are never retried.
+type RetryPolicy struct {
+	// Number of attempts, the first included. Requests aren't retried if below 2.
+	MaxAttempts int
+
+	// Delay before the first retry, doubled for every other retry, up to MaxDelay
+	// if that is set.
+	Delay    time.Duration
+	MaxDelay time.Duration
+
+	// Idempotent reports whether a call may be sent more than once. A batch is
+	// only retried if all its calls are. Calls are never retried if nil.
+	// CommandMessages are always idempotent.
+	Idempotent func(destination, operation string) bool
+}
+
+// retry reports whether the request should be sent again after err, once the
+// delay has passed.
+func (p *RetryPolicy) retry(ctx context.Context, attempt int, err error) bool {
+	if p == nil || attempt >= p.MaxAttempts || !isTransportError(err) {
+		return false
+	}
+
+	delay := p.Delay << uint(attempt-1)
+	if p.MaxDelay > 0 && (delay > p.MaxDelay || delay < 0) {
+		delay = p.MaxDelay
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// idempotent reports whether a call may be sent again.
+func (p *RetryPolicy) idempotent(destination, operation string) bool {
+	return p != nil && p.Idempotent != nil && p.Idempotent(destination, operation)
+}
+
+func isTransportError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var httpError *HTTPError
+	if errors.As(err, &httpError) {
+		switch httpError.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var urlError *url.Error
+	return errors.As(err, &urlError)
+}
+
+// gatewayURL returns the URL requests are sent to.
+func (c *Client) gatewayURL() string {
+	c.urlMu.Lock()
+	defer c.urlMu.Unlock()
+	if c.replaceURL != "" {
+		return c.replaceURL
+	}
+	return c.URL + c.urlSuffix
+}
+
+// applyReplyHeaders handles the headers servers use to keep the session when
+// cookies can't be used: AppendToGatewayUrl gives a suffix for the URL, such as
+// ?PHPSESSID=..., and ReplaceGatewayUrl a new URL.
+func (c *Client) applyReplyHeaders(headers []Header) {
+	c.urlMu.Lock()
+	defer c.urlMu.Unlock()
+	for _, header := range headers {
+		value, ok := header.Value.(string)
+		if !ok {
+			continue
+		}
+		switch header.Name {
+		case "AppendToGatewayUrl":
+			c.urlSuffix = value
+		case "ReplaceGatewayUrl":
+			c.replaceURL = value
+		}
+	}
+}
+
+// decodeReply decodes the body of an AcknowledgeMessage into result. Error
+// replies, that is ErrorMessage bodies or replies to /onStatus, are returned as
+// *FaultError.
+func decodeReply(reply AmfMessage, result interface{}) error {
+	body := reply.Body
+	object, isObject := body.(AvmObject)
+
+	if _, isError := body.(FlexErrorMessage); isError ||
+		strings.HasSuffix(reply.TargetUri, "onStatus") {
+		return replyError(body)
+	}
+
+	// Flex servers wrap the result in an AcknowledgeMessage; other AMF servers
+	// reply with the result itself.
+	if isObject && strings.HasPrefix(object.Class.Name, "flex.messaging.messages.") {
+		body, _ = object.Get("body")
+	}
+
+	if result == nil {
+		return nil
+	}
+	target := reflect.ValueOf(result)
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return errors.New("Call requires a pointer result")
+	}
+	return assignValue(target.Elem(), body)
+}
+
+// FaultError is an error reported by the server, either as an ErrorMessage or
+// as a reply to /onStatus.
+type FaultError struct {
+	FaultCode    string
+	FaultString  string
+	FaultDetail  string
+	RootCause    interface{}
+	ExtendedData map[string]interface{}
+}
+
+func (e *FaultError) Error() string {
+	message := fmt.Sprintf("amf: fault %s: %s", e.FaultCode, e.FaultString)
+	if e.FaultDetail != "" {
+		message += " (" + e.FaultDetail + ")"
+	}
+	return message
+}
+
+// replyError returns the fault reported by an error reply.
+func replyError(body interface{}) *FaultError {
+	switch v := body.(type) {
+	case FlexErrorMessage:
+		return &FaultError{
+			FaultCode:    v.FaultCode,
+			FaultString:  v.FaultString,
+			FaultDetail:  v.FaultDetail,
+			RootCause:    v.RootCause,
+			ExtendedData: v.ExtendedData,
+		}
+	case AvmObject:
+		fields, _ := objectFields(v)
+		return replyError(fields)
+	case map[string]interface{}:
+		// ErrorMessage fields, or the status objects of AMF0 servers.
+		fault := &FaultError{RootCause: v["rootCause"]}
+		fault.ExtendedData, _ = v["extendedData"].(map[string]interface{})
+		fault.FaultCode = toString(firstOf(v, "faultCode", "code"))
+		fault.FaultString = toString(firstOf(v, "faultString", "description"))
+		fault.FaultDetail = toString(firstOf(v, "faultDetail", "details"))
+		return fault
+	}
+	return &FaultError{FaultString: toString(body)}
+}
+
+// firstOf returns the first of the named fields that is set.
+func firstOf(fields map[string]interface{}, names ...string) interface{} {
+	for _, name := range names {
+		if value, ok := fields[name]; ok && value != nil {
+			return value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,419 @@
+package amf
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testSession is the state of the test server.
+type testSession struct {
+	// Number of pings, which start new sessions.
+	sessions int
+
+	// User logged in with a LOGIN command, and in the Credentials header.
+	user        string
+	credentials interface{}
+
+	// Headers written in replies.
+	headers []Header
+}
+
+// testServer answers every RemotingMessage with the body returned by reply. Pings
+// are acknowledged with a new DSId each time: ds-1, ds-2... Replies are written
+// in reverse order, so that clients have to match them by response URI.
+func testServer(t *testing.T, reply func(request FlexRemotingMessage, session *testSession) (string, interface{})) *httptest.Server {
+	session := &testSession{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bundle, err := DecodeMessageBundle(r.Body)
+		if err != nil {
+			t.Errorf("Server couldn't decode request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		session.credentials = nil
+		for _, header := range bundle.Headers {
+			if header.Name == "Credentials" {
+				session.credentials = header.Value
+			}
+		}
+
+		replyBundle := MessageBundle{AmfVersion: 3}
+		for _, message := range bundle.Messages {
+			body, _ := message.Body.([]interface{})
+			var status string
+			var replyBody interface{}
+			switch request := body[0].(type) {
+			case FlexRemotingMessage:
+				status, replyBody = reply(request, session)
+			case FlexCommandMessage:
+				status, replyBody = "/onResult", testAcknowledge(nil)
+				switch request.Operation {
+				case CLIENT_PING_OPERATION:
+					session.sessions++
+					session.user = ""
+					ack := replyBody.(AvmObject)
+					ack.Class.Properties = append(ack.Class.Properties, "headers", "clientId")
+					ack.StaticFields["headers"] = map[string]interface{}{
+						"DSId": fmt.Sprintf("ds-%d", session.sessions)}
+					ack.StaticFields["clientId"] = "client"
+				case LOGIN_OPERATION:
+					text, _ := request.Body.(string)
+					credentials, _ := base64.StdEncoding.DecodeString(text)
+					if string(credentials) != "sam:secret" {
+						status, replyBody = "/onStatus",
+							testErrorMessage("Client.Authentication", "bad credentials")
+					} else {
+						session.user = "sam"
+					}
+				case LOGOUT_OPERATION:
+					session.user = ""
+				default:
+					t.Errorf("Server received command %v", request)
+				}
+			default:
+				t.Errorf("Server received %v", body[0])
+			}
+			replyBundle.Messages = append([]AmfMessage{{
+				TargetUri:   message.ResponseUri + status,
+				ResponseUri: "null",
+				Body:        replyBody,
+			}}, replyBundle.Messages...)
+		}
+
+		replyBundle.Headers = session.headers
+
+		buffer := bytes.NewBuffer(make([]byte, 0))
+		EncodeMessageBundle(NewEncoder(buffer), &replyBundle)
+		w.Header().Set("Content-Type", "application/x-amf")
+		w.Write(buffer.Bytes())
+	}))
+}
+
+func testAcknowledge(body interface{}) AvmObject {
+	return AvmObject{
+		Class:        &AvmClass{Name: acknowledgeMessageClass, Properties: []string{"body"}},
+		StaticFields: map[string]interface{}{"body": body},
+	}
+}
+
+func testErrorMessage(code, description string) AvmObject {
+	return AvmObject{
+		Class: &AvmClass{Name: errorMessageClass,
+			Properties: []string{"faultCode", "faultString", "timestamp"}},
+		StaticFields: map[string]interface{}{"faultCode": code, "faultString": description,
+			"timestamp": 1.7e12},
+	}
+}
+
+func TestClientCall(t *testing.T) {
+	server := testServer(t, func(request FlexRemotingMessage, session *testSession) (string, interface{}) {
+		if request.Destination != "UserService" {
+			return "/onStatus", testErrorMessage("Server.Processing", "no such destination")
+		}
+		switch request.Operation {
+		case "find":
+			return "/onResult", testAcknowledge(map[string]interface{}{
+				"name": request.Body[0], "age": 42})
+		}
+		return "/onResult", testErrorMessage("Server.ResourceUnavailable", "no such method")
+	})
+	defer server.Close()
+
+	client := NewClient(server.URL)
+
+	var user struct {
+		Name string
+		Age  int
+	}
+	if err := client.Call(context.Background(), "UserService", "find", &user, "Sam"); err != nil {
+		t.Fatalf("Call returned error: %v", err)
+	}
+	if user.Name != "Sam" || user.Age != 42 {
+		t.Errorf("Wrong result: %+v", user)
+	}
+
+	var fault *FaultError
+	err := client.Call(context.Background(), "UserService", "delete", nil)
+	if !errors.As(err, &fault) || fault.FaultCode != "Server.ResourceUnavailable" ||
+		fault.FaultString != "no such method" {
+		t.Errorf("Expected a FaultError for an ErrorMessage reply, got %v", err)
+	}
+	err = client.Call(context.Background(), "Other", "find", nil, "Sam")
+	if !errors.As(err, &fault) || fault.FaultCode != "Server.Processing" {
+		t.Errorf("Expected a FaultError for an /onStatus reply, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = client.Call(ctx, "UserService", "find", &user, "Sam")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestClientSession(t *testing.T) {
+	rejected := false
+	server := testServer(t, func(request FlexRemotingMessage, session *testSession) (string, interface{}) {
+		dsID := request.Headers["DSId"]
+		if dsID == "ds-1" && !rejected {
+			rejected = true
+			return "/onStatus", testErrorMessage("Server.Processing.DuplicateSessionDetected",
+				"duplicate session")
+		}
+		if request.ClientId != "client" {
+			return "/onStatus", testErrorMessage("Server.Processing", "missing clientId")
+		}
+		return "/onResult", testAcknowledge(dsID)
+	})
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	if client.DSId() != "" {
+		t.Errorf("DSId set before the handshake: %s", client.DSId())
+	}
+
+	// The first session is rejected, so the client does the handshake again.
+	var dsID string
+	if err := client.Call(context.Background(), "Service", "op", &dsID); err != nil {
+		t.Fatalf("Call returned error: %v", err)
+	}
+	if dsID != "ds-2" || client.DSId() != "ds-2" {
+		t.Errorf("Wrong session: sent %s, kept %s", dsID, client.DSId())
+	}
+
+	// The session is reused.
+	if err := client.Call(context.Background(), "Service", "op", &dsID); err != nil || dsID != "ds-2" {
+		t.Errorf("Second call sent DSId %s (%v)", dsID, err)
+	}
+}
+
+func TestClientSlowHandshake(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := NewClient(server.URL)
+	go client.Call(context.Background(), "Service", "op", nil)
+	time.Sleep(20 * time.Millisecond)
+
+	// The client isn't locked while the handshake waits for the server.
+	done := make(chan string)
+	go func() { done <- client.DSId() }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("DSId blocked during the handshake")
+	}
+}
+
+func TestFaultError(t *testing.T) {
+	message := FlexErrorMessage{
+		FaultCode:    "Server.Processing",
+		FaultString:  "failed",
+		FaultDetail:  "line 3",
+		RootCause:    map[string]interface{}{"message": "NPE"},
+		ExtendedData: map[string]interface{}{"id": 7},
+	}
+	fault := replyError(message)
+	if fault.Error() != "amf: fault Server.Processing: failed (line 3)" {
+		t.Errorf("Wrong message: %s", fault.Error())
+	}
+	if fault.ExtendedData["id"] != 7 || fault.RootCause == nil {
+		t.Errorf("Wrong fault: %+v", fault)
+	}
+
+	// AMF0 status object.
+	fault = replyError(map[string]interface{}{"code": "NetConnection.Call.Failed",
+		"description": "no method"})
+	if fault.FaultCode != "NetConnection.Call.Failed" || fault.FaultString != "no method" {
+		t.Errorf("Wrong fault for status object: %+v", fault)
+	}
+}
+
+func TestClientBatch(t *testing.T) {
+	server := testServer(t, func(request FlexRemotingMessage, session *testSession) (string, interface{}) {
+		if request.Operation == "fail" {
+			return "/onStatus", testErrorMessage("Server.Processing", "failed")
+		}
+		return "/onResult", testAcknowledge(request.Body)
+	})
+	defer server.Close()
+
+	var numbers []int
+	var words []string
+	calls, err := NewClient(server.URL).Batch().
+		Add("Service", "echo", &numbers, 1, 2).
+		Add("Service", "fail", nil).
+		Add("Service", "echo", &words, "a").
+		Do(context.Background())
+	if err != nil {
+		t.Fatalf("Do returned error: %v", err)
+	}
+	if len(calls) != 3 {
+		t.Fatalf("Expected 3 calls, got %d", len(calls))
+	}
+
+	if calls[0].Err != nil || fmt.Sprint(numbers) != "[1 2]" {
+		t.Errorf("Wrong first result: %v (%v)", numbers, calls[0].Err)
+	}
+	var fault *FaultError
+	if !errors.As(calls[1].Err, &fault) || fault.FaultString != "failed" {
+		t.Errorf("Expected a fault for the second call, got %v", calls[1].Err)
+	}
+	if calls[2].Err != nil || fmt.Sprint(words) != "[a]" {
+		t.Errorf("Wrong third result: %v (%v)", words, calls[2].Err)
+	}
+}
+
+func TestClientLogin(t *testing.T) {
+	server := testServer(t, func(request FlexRemotingMessage, session *testSession) (string, interface{}) {
+		if request.Operation == "credentials" {
+			return "/onResult", testAcknowledge(session.credentials)
+		}
+		if session.user == "" {
+			return "/onStatus", testErrorMessage("Client.Authentication", "not logged in")
+		}
+		if request.Operation == "expire" {
+			session.user = ""
+		}
+		return "/onResult", testAcknowledge(session.user)
+	})
+	defer server.Close()
+
+	ctx := context.Background()
+	client := NewClient(server.URL)
+
+	var user string
+	if err := client.Call(ctx, "Service", "whoami", &user); !isAuthenticationFault(err) {
+		t.Errorf("Expected an authentication fault before login, got %v", err)
+	}
+	if err := client.Login(ctx, "sam", "wrong"); !isAuthenticationFault(err) {
+		t.Errorf("Expected an authentication fault for wrong credentials, got %v", err)
+	}
+	if err := client.Login(ctx, "sam", "secret"); err != nil {
+		t.Fatalf("Login returned error: %v", err)
+	}
+	if err := client.Call(ctx, "Service", "whoami", &user); err != nil || user != "sam" {
+		t.Errorf("Call after login returned %q, %v", user, err)
+	}
+
+	// The server forgets the user after this call, so the client logs in again.
+	client.Call(ctx, "Service", "expire", nil)
+	if err := client.Call(ctx, "Service", "whoami", &user); err != nil || user != "sam" {
+		t.Errorf("Call after expiry returned %q, %v", user, err)
+	}
+
+	if err := client.Logout(ctx); err != nil {
+		t.Fatalf("Logout returned error: %v", err)
+	}
+	if err := client.Call(ctx, "Service", "whoami", &user); !isAuthenticationFault(err) {
+		t.Errorf("Expected an authentication fault after logout, got %v", err)
+	}
+
+	// Credentials header.
+	client.SetCredentials("sam", "secret")
+	var credentials map[string]string
+	if err := client.Call(ctx, "Service", "credentials", &credentials); err != nil ||
+		credentials["userid"] != "sam" || credentials["password"] != "secret" {
+		t.Errorf("Server received credentials %v (%v)", credentials, err)
+	}
+}
+
+func TestClientGatewayUrl(t *testing.T) {
+	server := testServer(t, func(request FlexRemotingMessage, session *testSession) (string, interface{}) {
+		session.headers = []Header{{Name: "AppendToGatewayUrl", Value: "?PHPSESSID=abc"}}
+		return "/onResult", testAcknowledge(nil)
+	})
+	defer server.Close()
+
+	// Record the URL and cookies of requests, and set a session cookie.
+	var query, cookie []string
+	handler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = append(query, r.URL.RawQuery)
+		if c, err := r.Cookie("JSESSIONID"); err == nil {
+			cookie = append(cookie, c.Value)
+		} else {
+			cookie = append(cookie, "")
+		}
+		http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: "xyz"})
+		handler.ServeHTTP(w, r)
+	})
+
+	client := NewClient(server.URL)
+	for i := 0; i < 2; i++ {
+		if err := client.Call(context.Background(), "Service", "op", nil); err != nil {
+			t.Fatalf("Call returned error: %v", err)
+		}
+	}
+
+	// Ping, then two calls.
+	if fmt.Sprint(query) != "[  PHPSESSID=abc]" {
+		t.Errorf("Wrong queries: %q", query)
+	}
+	if fmt.Sprint(cookie) != "[ xyz xyz]" {
+		t.Errorf("Wrong cookies: %q", cookie)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	server := testServer(t, func(request FlexRemotingMessage, session *testSession) (string, interface{}) {
+		return "/onResult", testAcknowledge(request.Operation)
+	})
+	defer server.Close()
+
+	// Fail all but every third request with an error page.
+	requests := 0
+	handler := server.Config.Handler
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests%3 != 0 {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("<html>busy</html>"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	client := NewClient(server.URL)
+	client.Retry = &RetryPolicy{
+		MaxAttempts: 3,
+		Delay:       time.Millisecond,
+		Idempotent: func(destination, operation string) bool {
+			return operation == "get"
+		},
+	}
+
+	// The ping and the call each succeed on their third attempt.
+	var result string
+	if err := client.Call(context.Background(), "Service", "get", &result); err != nil || result != "get" {
+		t.Errorf("Call returned %q, %v", result, err)
+	}
+	if requests != 6 {
+		t.Errorf("Expected 6 requests, got %d", requests)
+	}
+
+	// Other operations aren't retried.
+	var httpError *HTTPError
+	err := client.Call(context.Background(), "Service", "set", nil)
+	if !errors.As(err, &httpError) || httpError.StatusCode != http.StatusServiceUnavailable ||
+		string(httpError.Body) != "<html>busy</html>" {
+		t.Errorf("Expected an HTTPError, got %v", err)
+	}
+	if requests != 7 {
+		t.Errorf("Expected 7 requests, got %d", requests)
+	}
+}
@@ -0,0 +1,303 @@
+package amf
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ServicesConfig is a BlazeDS services-config.xml file. Only what concerns
+// remoting is read: remoting services and their destinations, channels, and
+// security constraints.
+type ServicesConfig struct {
+	XMLName xml.Name `xml:"services-config"`
+
+	// Services, including those of the files named by <service-include>
+	// elements once loaded by LoadServicesConfig.
+	Services        []ServiceConfig  `xml:"services>service"`
+	Includes        []ServiceInclude `xml:"services>service-include"`
+	DefaultChannels []ChannelRef     `xml:"services>default-channels>channel"`
+
+	SecurityConstraints []SecurityConstraint `xml:"security>security-constraint"`
+	Channels            []ChannelDefinition  `xml:"channels>channel-definition"`
+}
+
+// ServiceInclude names a file holding a service, such as remoting-config.xml,
+// relative to the services-config.xml file.
+type ServiceInclude struct {
+	FilePath string `xml:"file-path,attr"`
+}
+
+// ServiceConfig is a <service> element, such as the RemotingService of
+// remoting-config.xml.
+type ServiceConfig struct {
+	ID              string              `xml:"id,attr"`
+	Class           string              `xml:"class,attr"`
+	MessageTypes    string              `xml:"messageTypes,attr"`
+	DefaultChannels []ChannelRef        `xml:"default-channels>channel"`
+	Destinations    []DestinationConfig `xml:"destination"`
+}
+
+// DestinationConfig is a <destination> element. Source is the class serving the
+// destination, which names the Go service registered for it.
+type DestinationConfig struct {
+	ID       string              `xml:"id,attr"`
+	Channels []ChannelRef        `xml:"channels>channel"`
+	Source   string              `xml:"properties>source"`
+	Security *SecurityConstraint `xml:"security>security-constraint"`
+}
+
+// ChannelRef refers to a channel definition.
+type ChannelRef struct {
+	Ref string `xml:"ref,attr"`
+}
+
+// SecurityConstraint restricts destinations to users logged in, having one of
+// Roles if any. Constraints of destinations can refer to one defined in the
+// <security> section by Ref.
+type SecurityConstraint struct {
+	ID         string   `xml:"id,attr"`
+	Ref        string   `xml:"ref,attr"`
+	AuthMethod string   `xml:"auth-method"`
+	Roles      []string `xml:"roles>role"`
+}
+
+// ChannelDefinition is a <channel-definition> element.
+type ChannelDefinition struct {
+	ID       string         `xml:"id,attr"`
+	Class    string         `xml:"class,attr"`
+	Endpoint EndpointConfig `xml:"endpoint"`
+}
+
+// EndpointConfig is the endpoint of a channel. Its URL may hold the tokens
+// {server.name}, {server.port} and {context.root}. Older files give it as uri.
+type EndpointConfig struct {
+	URL   string `xml:"url,attr"`
+	URI   string `xml:"uri,attr"`
+	Class string `xml:"class,attr"`
+}
+
+const remotingServiceClass = "flex.messaging.services.RemotingService"
+
+// LoadServicesConfig reads a services-config.xml file, and the service files it
+// includes.
+func LoadServicesConfig(path string) (*ServicesConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &ServicesConfig{}
+	if err := xml.Unmarshal(data, config); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %v", path, err))
+	}
+
+	for _, include := range config.Includes {
+		includePath := filepath.Join(filepath.Dir(path), include.FilePath)
+		data, err := os.ReadFile(includePath)
+		if err != nil {
+			return nil, err
+		}
+		var service ServiceConfig
+		if err := xml.Unmarshal(data, &service); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %v", includePath, err))
+		}
+		config.Services = append(config.Services, service)
+	}
+	return config, nil
+}
+
+// EndpointPaths returns the URL paths of the endpoints of the channels, with
+// contextRoot for {context.root}, for serving the gateway on each of them.
+func (config *ServicesConfig) EndpointPaths(contextRoot string) []string {
+	var paths []string
+	for _, channel := range config.Channels {
+		if path, ok := channel.endpointPath(contextRoot); ok {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// endpointPath returns the URL path of the endpoint of a channel.
+func (channel *ChannelDefinition) endpointPath(contextRoot string) (string, bool) {
+	replacer := strings.NewReplacer(
+		"{server.name}", "localhost",
+		"{server.port}", "80",
+		"{context.root}", strings.Trim(contextRoot, "/"))
+
+	endpoint := channel.Endpoint.URL
+	if endpoint == "" {
+		endpoint = channel.Endpoint.URI
+	}
+	parsed, err := url.Parse(replacer.Replace(endpoint))
+	if err != nil || endpoint == "" {
+		return "", false
+	}
+	path := "/" + strings.TrimLeft(parsed.Path, "/")
+	return strings.Replace(path, "//", "/", -1), true
+}
+
+// LoadConfig configures the gateway with a services-config.xml file, as
+// Configure does.
+func (gw *Gateway) LoadConfig(path, contextRoot string) error {
+	config, err := LoadServicesConfig(path)
+	if err != nil {
+		return err
+	}
+	return gw.Configure(config, contextRoot)
+}
+
+// Configure defines the remoting destinations of config. Each destination is
+// served by the Go service registered under the name of its source, or under its
+// own id if the source is "*" or missing:
+//
+//	gw.Register("com.example.UserService", &UserService{})
+//	gw.LoadConfig("WEB-INF/flex/services-config.xml", "/app")
+//
+// Once configured, the gateway only serves the destinations of config: services
+// can no longer be called under the names they were registered with.
+//
+// The channel of a call is the one whose endpoint path, with contextRoot for
+// {context.root} as in EndpointPaths, is the path the request was received at
+// (r.URL.Path, so prefixes must not be stripped). Calls received at the endpoint
+// of a channel the destination isn't on, or at no endpoint, are rejected.
+//
+// Destinations with a security constraint require the user of the session to
+// be logged in, and to have one of the roles of the constraint as checked by
+// Authorize.
+//
+// Configure changes nothing if it returns an error. Like Register, it must not
+// be called while the gateway is serving requests.
+func (gw *Gateway) Configure(config *ServicesConfig, contextRoot string) error {
+	channels := make(map[string]bool)
+	channelPaths := make(map[string]string)
+	for _, channel := range config.Channels {
+		channels[channel.ID] = true
+		if path, ok := channel.endpointPath(contextRoot); ok {
+			channelPaths[path] = channel.ID
+		}
+	}
+	constraints := make(map[string]*SecurityConstraint)
+	for i := range config.SecurityConstraints {
+		constraints[config.SecurityConstraints[i].ID] = &config.SecurityConstraints[i]
+	}
+
+	// Installed once all destinations are valid.
+	services := make(map[string]*service, len(gw.services))
+	for name, s := range gw.services {
+		services[name] = s
+	}
+
+	for _, serviceConfig := range config.Services {
+		if serviceConfig.Class != remotingServiceClass &&
+			!strings.Contains(serviceConfig.MessageTypes, remotingMessageClass) {
+			continue
+		}
+
+		defaultChannels := serviceConfig.DefaultChannels
+		if len(defaultChannels) == 0 {
+			defaultChannels = config.DefaultChannels
+		}
+
+		for _, destination := range serviceConfig.Destinations {
+			source := destination.Source
+			if source == "" || source == "*" {
+				source = destination.ID
+			}
+			s, ok := services[source]
+			if !ok {
+				return errors.New(fmt.Sprintf("destination %s: no service registered for %s",
+					destination.ID, source))
+			}
+			if existing, ok := services[destination.ID]; ok && existing.value != s.value {
+				return errors.New(fmt.Sprintf("destination %s: another service is registered under that name",
+					destination.ID))
+			}
+
+			refs := destination.Channels
+			if len(refs) == 0 {
+				refs = defaultChannels
+			}
+			var destinationChannels []string
+			for _, ref := range refs {
+				if !channels[ref.Ref] {
+					return errors.New(fmt.Sprintf("destination %s: unknown channel %s",
+						destination.ID, ref.Ref))
+				}
+				destinationChannels = append(destinationChannels, ref.Ref)
+			}
+
+			security := destination.Security
+			if security != nil && security.Ref != "" {
+				if security, ok = constraints[security.Ref]; !ok {
+					return errors.New(fmt.Sprintf("destination %s: unknown security constraint %s",
+						destination.ID, destination.Security.Ref))
+				}
+			}
+
+			services[destination.ID] = &service{
+				name:       destination.ID,
+				value:      s.value,
+				methods:    s.methods,
+				configured: true,
+				channels:   destinationChannels,
+				security:   security,
+			}
+		}
+	}
+	gw.services = services
+	gw.configured = true
+	gw.channelPaths = channelPaths
+	return nil
+}
+
+// checkAccess enforces the channels and security constraint of a destination.
+func (gw *Gateway) checkAccess(ctx context.Context, s *service, call *Call) error {
+	if len(s.channels) > 0 {
+		var path string
+		if call.Request != nil {
+			path = call.Request.URL.Path
+		}
+		channel, ok := gw.channelPaths[path]
+		if !ok {
+			return &FaultError{FaultCode: "Server.Processing", FaultString: fmt.Sprintf(
+				"Destination '%s' not accessible at %s", s.name, path)}
+		}
+		if !containsString(s.channels, channel) {
+			return &FaultError{FaultCode: "Server.Processing", FaultString: fmt.Sprintf(
+				"Destination '%s' not accessible over channel '%s'", s.name, channel)}
+		}
+	}
+
+	if s.security == nil {
+		return nil
+	}
+	var user string
+	if session, ok := SessionFromContext(ctx); ok {
+		user = session.User()
+	}
+	if user == "" {
+		return &FaultError{FaultCode: "Client.Authentication",
+			FaultString: "Login required before authorization can proceed"}
+	}
+	if len(s.security.Roles) > 0 &&
+		(gw.Authorize == nil || !gw.Authorize(ctx, user, s.security.Roles)) {
+		return &FaultError{FaultCode: "Client.Authorization", FaultString: fmt.Sprintf(
+			"User %s is not authorized to access destination %s", user, s.name)}
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
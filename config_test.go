@@ -0,0 +1,187 @@
+package amf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testServicesConfig = `<?xml version="1.0" encoding="UTF-8"?>
+<services-config>
+  <services>
+    <service-include file-path="remoting-config.xml"/>
+    <default-channels>
+      <channel ref="my-amf"/>
+    </default-channels>
+  </services>
+  <security>
+    <security-constraint id="admins">
+      <auth-method>Custom</auth-method>
+      <roles>
+        <role>admin</role>
+      </roles>
+    </security-constraint>
+  </security>
+  <channels>
+    <channel-definition id="my-amf" class="mx.messaging.channels.AMFChannel">
+      <endpoint url="http://{server.name}:{server.port}/{context.root}/messagebroker/amf"
+                class="flex.messaging.endpoints.AMFEndpoint"/>
+    </channel-definition>
+    <channel-definition id="my-secure-amf" class="mx.messaging.channels.SecureAMFChannel">
+      <endpoint url="https://{server.name}:{server.port}/{context.root}/messagebroker/amfsecure"
+                class="flex.messaging.endpoints.SecureAMFEndpoint"/>
+    </channel-definition>
+  </channels>
+</services-config>`
+
+const testRemotingConfig = `<?xml version="1.0" encoding="UTF-8"?>
+<service id="remoting-service" class="flex.messaging.services.RemotingService">
+  <destination id="items">
+    <properties>
+      <source>com.example.ItemService</source>
+    </properties>
+  </destination>
+  <destination id="adminItems">
+    <channels>
+      <channel ref="my-secure-amf"/>
+    </channels>
+    <properties>
+      <source>com.example.ItemService</source>
+    </properties>
+    <security>
+      <security-constraint ref="admins"/>
+    </security>
+  </destination>
+</service>`
+
+func TestLoadServicesConfig(t *testing.T) {
+	config, err := LoadServicesConfig("tests/services-config.xml")
+	if err != nil {
+		t.Fatalf("LoadServicesConfig returned error: %v", err)
+	}
+	if len(config.Services) != 1 || len(config.Services[0].Destinations) != 1 ||
+		config.Services[0].Destinations[0].Source != "*" {
+		t.Errorf("Wrong services: %+v", config.Services)
+	}
+	if paths := config.EndpointPaths(""); len(paths) != 1 || paths[0] != "/" {
+		t.Errorf("Wrong endpoint paths: %v", paths)
+	}
+
+	gw := NewGateway()
+	if err := gw.Configure(config, ""); err == nil {
+		t.Errorf("Expected an error for a destination without service")
+	}
+	gw.Register("amfgo", &testService{})
+	if err := gw.Configure(config, ""); err != nil {
+		t.Errorf("Configure returned error: %v", err)
+	}
+}
+
+func TestGatewayConfig(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "services-config.xml"), []byte(testServicesConfig), 0644)
+	os.WriteFile(filepath.Join(dir, "remoting-config.xml"), []byte(testRemotingConfig), 0644)
+
+	config, err := LoadServicesConfig(filepath.Join(dir, "services-config.xml"))
+	if err != nil {
+		t.Fatalf("LoadServicesConfig returned error: %v", err)
+	}
+	paths := config.EndpointPaths("/app")
+	if len(paths) != 2 || paths[0] != "/app/messagebroker/amf" ||
+		paths[1] != "/app/messagebroker/amfsecure" {
+		t.Errorf("Wrong endpoint paths: %v", paths)
+	}
+
+	gw := NewGateway()
+	gw.Register("com.example.ItemService", &testService{prefix: "item"})
+	gw.Authenticate = func(ctx context.Context, username, password string) error {
+		return nil
+	}
+	gw.Authorize = func(ctx context.Context, user string, roles []string) bool {
+		return user == "root"
+	}
+	if err := gw.Configure(config, "/app"); err != nil {
+		t.Fatalf("Configure returned error: %v", err)
+	}
+	mux := http.NewServeMux()
+	for _, path := range paths {
+		mux.Handle(path, gw)
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	ctx := context.Background()
+	client := NewClient(server.URL + "/app/messagebroker/amf")
+	secureClient := NewClient(server.URL + "/app/messagebroker/amfsecure")
+
+	var item testItem
+	if err := client.Call(ctx, "items", "find", &item, 3); err != nil || item.Name != "item3" {
+		t.Errorf("find returned %+v, %v", item, err)
+	}
+
+	// The service isn't served under its own name, which has no constraint.
+	var fault *FaultError
+	if err := client.Call(ctx, "com.example.ItemService", "find", &item, 3); !errors.As(err, &fault) {
+		t.Errorf("Expected a fault calling the source of a destination, got %v", err)
+	}
+
+	// Destinations are only served over their channels, found from the path of
+	// the request whatever the DSEndpoint header tells.
+	if err := client.Call(ctx, "adminItems", "find", &item, 3); !errors.As(err, &fault) {
+		t.Errorf("Expected a fault for a call over another channel, got %v", err)
+	}
+	if err := secureClient.Call(ctx, "items", "find", &item, 3); !errors.As(err, &fault) {
+		t.Errorf("Expected a fault for a call over another channel, got %v", err)
+	}
+	call := &Call{Message: FlexRemotingMessage{Destination: "items", Operation: "find",
+		Body: []interface{}{3}, Headers: map[string]interface{}{"DSEndpoint": "my-amf"}}}
+	if _, err := gw.dispatch(ctx, call); !errors.As(err, &fault) {
+		t.Errorf("Expected a fault for a call received at no endpoint, got %v", err)
+	}
+
+	if err := secureClient.Call(ctx, "adminItems", "find", &item, 3); !errors.As(err, &fault) ||
+		fault.FaultCode != "Client.Authentication" {
+		t.Errorf("Expected a Client.Authentication fault, got %v", err)
+	}
+	secureClient.Login(ctx, "sam", "secret")
+	if err := secureClient.Call(ctx, "adminItems", "find", &item, 3); !errors.As(err, &fault) ||
+		fault.FaultCode != "Client.Authorization" {
+		t.Errorf("Expected a Client.Authorization fault, got %v", err)
+	}
+	secureClient.Logout(ctx)
+	secureClient.Login(ctx, "root", "secret")
+	if err := secureClient.Call(ctx, "adminItems", "find", &item, 4); err != nil || item.Name != "item4" {
+		t.Errorf("find returned %+v, %v", item, err)
+	}
+}
+
+func TestGatewayConfigErrors(t *testing.T) {
+	config := &ServicesConfig{
+		Channels: []ChannelDefinition{{ID: "my-amf",
+			Endpoint: EndpointConfig{URL: "http://{server.name}/messagebroker/amf"}}},
+		DefaultChannels: []ChannelRef{{Ref: "my-amf"}},
+		Services: []ServiceConfig{{Class: remotingServiceClass, Destinations: []DestinationConfig{
+			{ID: "items", Source: "com.example.ItemService"},
+			{ID: "orders", Source: "com.example.ItemService",
+				Channels: []ChannelRef{{Ref: "my-polling-amf"}}},
+		}}},
+	}
+
+	gw := NewGateway()
+	gw.Register("com.example.ItemService", &testService{prefix: "item"})
+	if err := gw.Configure(config, ""); err == nil {
+		t.Fatalf("Expected an error for an unknown channel")
+	}
+
+	// The valid destination before the error wasn't installed.
+	if _, ok := gw.services["items"]; ok || gw.configured || gw.channelPaths != nil {
+		t.Errorf("Configure left a partial configuration: %v, %v, %v",
+			gw.services, gw.configured, gw.channelPaths)
+	}
+	if _, ok := gw.services["com.example.ItemService"]; !ok {
+		t.Errorf("Configure removed the registered service")
+	}
+}
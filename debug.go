@@ -0,0 +1,218 @@
+package amf
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Envelopes are logged at debug level by the decoders and encoders of bundles,
+// when their Logger has it enabled.
+
+// maxFormatDepth limits how deep formatValue descends, which also stops it on
+// cyclic object graphs.
+const maxFormatDepth = 8
+
+// redacted replaces secrets in logs.
+const redacted = "<redacted>"
+
+// LogValue describes the bundle in a readable form for slog. The password of
+// Credentials headers and the credentials of LOGIN commands are left out.
+func (bundle *MessageBundle) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.Int("version", int(bundle.AmfVersion))}
+	for _, header := range bundle.Headers {
+		name := "header " + header.Name
+		if header.MustUnderstand {
+			name += " (mustUnderstand)"
+		}
+		value := header.Value
+		if header.Name == "Credentials" {
+			value = redactPassword(value)
+		}
+		attrs = append(attrs, slog.String(name, formatValue(value)))
+	}
+	for _, message := range bundle.Messages {
+		attrs = append(attrs, slog.String(message.TargetUri+" "+message.ResponseUri,
+			formatValue(redactLogin(message.Body))))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// redactPassword returns the value of a Credentials header without its
+// password.
+func redactPassword(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for name, field := range v {
+			copied[name] = field
+		}
+		if _, ok := copied["password"]; ok {
+			copied["password"] = redacted
+		}
+		return copied
+	case AvmObject:
+		v.StaticFields = redactPassword(v.StaticFields).(map[string]interface{})
+		v.DynamicFields = redactPassword(v.DynamicFields).(map[string]interface{})
+		return v
+	case RawValue:
+		return v
+	}
+	return redacted
+}
+
+// redactLogin returns a message body with the credentials of LOGIN commands
+// left out.
+func redactLogin(body interface{}) interface{} {
+	args, ok := body.([]interface{})
+	if !ok || len(args) != 1 {
+		return body
+	}
+	command, ok := args[0].(FlexCommandMessage)
+	if !ok || command.Operation != LOGIN_OPERATION {
+		return body
+	}
+	command.Body = redacted
+	return []interface{}{command}
+}
+
+func debugEnabled(logger *slog.Logger) bool {
+	return logger != nil && logger.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// formatValue writes a decoded value the way it reads in ActionScript: objects
+// with their class name and members, arrays in brackets and strings quoted.
+func formatValue(value interface{}) string {
+	var builder strings.Builder
+	writeFormatted(&builder, reflect.ValueOf(value), 0)
+	return builder.String()
+}
+
+func writeFormatted(builder *strings.Builder, value reflect.Value, depth int) {
+	if !value.IsValid() {
+		builder.WriteString("null")
+		return
+	}
+	if depth > maxFormatDepth {
+		builder.WriteString("...")
+		return
+	}
+
+	if value.CanInterface() {
+		switch v := value.Interface().(type) {
+		case AvmObject:
+			writeAvmObject(builder, &v, depth)
+			return
+		case *AvmObject:
+			if v != nil {
+				writeAvmObject(builder, v, depth)
+				return
+			}
+		case RawValue:
+			fmt.Fprintf(builder, "<raw %d bytes>", len(v.Bytes))
+			return
+		case time.Time:
+			builder.WriteString(v.UTC().Format(time.RFC3339Nano))
+			return
+		case []byte:
+			fmt.Fprintf(builder, "<%d bytes>", len(v))
+			return
+		}
+	}
+
+	switch value.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if value.IsNil() {
+			builder.WriteString("null")
+			return
+		}
+		writeFormatted(builder, value.Elem(), depth)
+	case reflect.String:
+		builder.WriteString(strconv.Quote(value.String()))
+	case reflect.Slice, reflect.Array:
+		builder.WriteString("[")
+		for i := 0; i < value.Len(); i++ {
+			if i > 0 {
+				builder.WriteString(", ")
+			}
+			writeFormatted(builder, value.Index(i), depth+1)
+		}
+		builder.WriteString("]")
+	case reflect.Map:
+		keys := value.MapKeys()
+		names := make([]string, len(keys))
+		for i, key := range keys {
+			names[i] = fmt.Sprint(key.Interface())
+		}
+		sort.Sort(byName{names, keys})
+		builder.WriteString("{")
+		for i, key := range keys {
+			if i > 0 {
+				builder.WriteString(", ")
+			}
+			builder.WriteString(names[i])
+			builder.WriteString(": ")
+			writeFormatted(builder, value.MapIndex(key), depth+1)
+		}
+		builder.WriteString("}")
+	case reflect.Struct:
+		builder.WriteString(value.Type().Name())
+		builder.WriteString("{")
+		info := structInfoOf(value.Type())
+		for i, field := range info.fields {
+			if i > 0 {
+				builder.WriteString(", ")
+			}
+			builder.WriteString(field.name)
+			builder.WriteString(": ")
+			writeFormatted(builder, value.Field(field.index), depth+1)
+		}
+		builder.WriteString("}")
+	default:
+		fmt.Fprint(builder, value.Interface())
+	}
+}
+
+func writeAvmObject(builder *strings.Builder, object *AvmObject, depth int) {
+	if object.Class != nil {
+		builder.WriteString(object.Class.Name)
+	}
+	builder.WriteString("{")
+	first := true
+	write := func(fields map[string]interface{}, keys []string) {
+		for _, key := range orderedKeys(keys, fields) {
+			if !first {
+				builder.WriteString(", ")
+			}
+			first = false
+			builder.WriteString(key)
+			builder.WriteString(": ")
+			writeFormatted(builder, reflect.ValueOf(fields[key]), depth+1)
+		}
+	}
+	var properties []string
+	if object.Class != nil {
+		properties = object.Class.Properties
+	}
+	write(object.StaticFields, properties)
+	write(object.DynamicFields, object.DynamicKeys)
+	builder.WriteString("}")
+}
+
+// byName sorts map keys by their printed form.
+type byName struct {
+	names []string
+	keys  []reflect.Value
+}
+
+func (s byName) Len() int           { return len(s.names) }
+func (s byName) Less(i, j int) bool { return s.names[i] < s.names[j] }
+func (s byName) Swap(i, j int) {
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
@@ -0,0 +1,92 @@
+package amf
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFormatValue(t *testing.T) {
+	object := AvmObject{
+		Class:         &AvmClass{Name: "User", Properties: []string{"name", "id"}},
+		StaticFields:  map[string]interface{}{"id": 1, "name": "Sam"},
+		DynamicFields: map[string]interface{}{"tags": []interface{}{"a", nil}},
+	}
+	expected := `User{name: "Sam", id: 1, tags: ["a", null]}`
+	if result := formatValue(object); result != expected {
+		t.Errorf("formatValue returned %s, expected %s", result, expected)
+	}
+
+	cyclic := map[string]interface{}{}
+	cyclic["self"] = cyclic
+	if result := formatValue(cyclic); !strings.Contains(result, "...") {
+		t.Errorf("formatValue didn't stop on a cycle: %s", result)
+	}
+}
+
+func TestDebugLogging(t *testing.T) {
+	var clientLog, gatewayLog bytes.Buffer
+	debug := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	gw := NewGateway()
+	gw.Register("Items", &testService{prefix: "item"})
+	gw.Logger = slog.New(slog.NewTextHandler(&gatewayLog, debug))
+	server := httptest.NewServer(gw)
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.Logger = slog.New(slog.NewTextHandler(&clientLog, debug))
+	var item testItem
+	if err := client.Call(context.Background(), "Items", "find", &item, 3); err != nil {
+		t.Fatalf("Call returned error: %v", err)
+	}
+
+	for _, log := range []string{clientLog.String(), gatewayLog.String()} {
+		if !strings.Contains(log, "AMF envelope") || !strings.Contains(log, `operation: \"find\"`) {
+			t.Errorf("Envelopes weren't logged: %s", log)
+		}
+	}
+
+	// Silent unless debug level is enabled.
+	gatewayLog.Reset()
+	gw.Logger = slog.New(slog.NewTextHandler(&gatewayLog, nil))
+	if err := client.Call(context.Background(), "Items", "find", &item, 3); err != nil {
+		t.Fatalf("Call returned error: %v", err)
+	}
+	if gatewayLog.Len() != 0 {
+		t.Errorf("Expected no log at info level, got %s", gatewayLog.String())
+	}
+}
+
+func TestDebugLoggingHidesCredentials(t *testing.T) {
+	var clientLog, gatewayLog bytes.Buffer
+	debug := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	gw := NewGateway()
+	gw.Register("Items", &testService{prefix: "item"})
+	gw.Authenticate = func(ctx context.Context, username, password string) error {
+		return nil
+	}
+	gw.Logger = slog.New(slog.NewTextHandler(&gatewayLog, debug))
+	server := httptest.NewServer(gw)
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.Logger = slog.New(slog.NewTextHandler(&clientLog, debug))
+	client.SetCredentials("sam", "hunter2")
+	if err := client.Login(context.Background(), "sam", "hunter2"); err != nil {
+		t.Fatalf("Login returned error: %v", err)
+	}
+
+	login := base64.StdEncoding.EncodeToString([]byte("sam:hunter2"))
+	for _, log := range []string{clientLog.String(), gatewayLog.String()} {
+		if !strings.Contains(log, redacted) || strings.Contains(log, "hunter2") ||
+			strings.Contains(log, login) {
+			t.Errorf("Credentials weren't hidden: %s", log)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package amf
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// structField is an exported struct field and the member name it maps to.
+type structField struct {
+	name  string
+	index int
+}
+
+// structInfo describes how a struct type maps to AMF members.
+//
+// Members are named after the fields with the first letter in lower case, unless
+// a tag gives another name:
+//
+//	Name  string                 `amf:"userName"`
+//	Cache []byte                 `amf:"-"`
+//	Extra map[string]interface{} `amf:",extra"`
+//
+// The ",extra" field collects the members that match no other field when
+// decoding, and its entries are written as dynamic members when encoding.
+type structInfo struct {
+	fields []structField
+	extra  int
+}
+
+var structInfoCache sync.Map
+
+func structInfoOf(structType reflect.Type) *structInfo {
+	if info, ok := structInfoCache.Load(structType); ok {
+		return info.(*structInfo)
+	}
+
+	info := &structInfo{extra: -1}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := lowerFirst(field.Name)
+		tag := strings.Split(field.Tag.Get("amf"), ",")
+		if tag[0] == "-" && len(tag) == 1 {
+			continue
+		}
+		if tag[0] != "" {
+			name = tag[0]
+		}
+		if len(tag) > 1 && tag[1] == "extra" && field.Type.Kind() == reflect.Map &&
+			field.Type.Key().Kind() == reflect.String {
+			info.extra = i
+			continue
+		}
+		info.fields = append(info.fields, structField{name, i})
+	}
+
+	structInfoCache.Store(structType, info)
+	return info
+}
+
+// field returns the field for a member name, falling back to a case-insensitive
+// match.
+func (info *structInfo) field(name string) (structField, bool) {
+	for _, field := range info.fields {
+		if field.name == name {
+			return field, true
+		}
+	}
+	for _, field := range info.fields {
+		if strings.EqualFold(field.name, name) {
+			return field, true
+		}
+	}
+	return structField{}, false
+}
+
+// extraFields returns the entries of the ",extra" field of a struct value, if it
+// has one, leaving out those that a field already names.
+func (info *structInfo) extraFields(value reflect.Value) ([]mapEntry, error) {
+	if info.extra < 0 || value.Field(info.extra).Len() == 0 {
+		return nil, nil
+	}
+
+	entries, err := sortedMapEntries(value.Field(info.extra))
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(info.fields))
+	for _, field := range info.fields {
+		names[field.name] = true
+	}
+	result := entries[:0]
+	for _, entry := range entries {
+		if !names[entry.key] {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
@@ -2,88 +2,500 @@ package amf
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func handleGet(w http.ResponseWriter) {
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(405)
-	fmt.Fprintf(w, "405 Method Not Allowed\n\n"+
-		"To access this amf.go gateway you must use POST requests "+
-		"(GET received))")
+// Gateway serves Flex remoting: it dispatches the calls it receives over HTTP
+// to the Go services registered with it.
+type Gateway struct {
+	services map[string]*service
+
+	// Authenticate checks the credentials of LOGIN commands. Logins fail if nil.
+	Authenticate func(ctx context.Context, username, password string) error
+
+	// Authorize reports whether a user has one of roles, for destinations whose
+	// security constraint lists roles. Access is denied if nil.
+	Authorize func(ctx context.Context, user string, roles []string) bool
+
+	// Logger receives the errors of the gateway, and the request and reply
+	// envelopes if debug level is enabled. Nothing is logged if nil.
+	Logger *slog.Logger
+
+	// ServerName is sent in the Server header, if set.
+	ServerName string
+
+	// MaxBodySize limits the size of requests. DefaultMaxBodySize applies if 0.
+	// Decoding a request allocates no more than its size allows, and fails on
+	// values nested deeper than MaxDepth.
+	MaxBodySize int64
+
+	// AllowedMethods lists the HTTP methods accepted, POST only if empty.
+	AllowedMethods []string
+
+	// ErrorPolicy sets what faults tell clients about errors.
+	ErrorPolicy ErrorPolicy
+
+	// Concurrency is the number of messages of an envelope handled at once.
+	// Messages are handled one after the other if 0 or 1. Replies are in the
+	// order of the messages either way.
+	Concurrency int
+
+	// MessageTimeout limits the time given to each message, through the context
+	// passed to the services. There is no limit if 0.
+	MessageTimeout time.Duration
+
+	// Sessions keeps the sessions of clients, found by cookie or DSId. There
+	// are no sessions if nil. NewGateway sets it to a MemoryStore.
+	Sessions SessionStore
+
+	// SessionCookie names the session cookie. DefaultSessionCookie applies if
+	// empty.
+	SessionCookie string
+
+	middleware     []Middleware
+	headerHandlers map[string]HeaderHandler
+
+	// configured is set by Configure: only the destinations it defined are
+	// served then, over the channels found by endpoint path in channelPaths.
+	configured   bool
+	channelPaths map[string]string
 }
 
-func writeReply500(w http.ResponseWriter) {
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(500)
-	fmt.Fprintf(w, "500 Internal Server Error\n\n"+
-		"Unexplained error")
+// DefaultMaxBodySize is the size limit of requests if Gateway.MaxBodySize is 0.
+const DefaultMaxBodySize = 10 << 20
+
+// ErrorPolicy sets what faults tell clients about the errors returned by
+// services.
+type ErrorPolicy int
+
+const (
+	// ReportErrors sends the message of errors as the fault string.
+	ReportErrors ErrorPolicy = iota
+
+	// HideErrors sends a generic fault string instead, and logs the error.
+	// Services can still report errors on purpose by returning a *FaultError.
+	HideErrors
+)
+
+// DefaultGateway is the gateway used by HttpHandler.
+var DefaultGateway = NewGateway()
+
+// NewGateway returns a gateway without services, keeping sessions in memory.
+func NewGateway() *Gateway {
+	return &Gateway{
+		services: make(map[string]*service),
+		Sessions: NewMemoryStore(DefaultSessionTimeout),
+	}
 }
 
+// HttpHandler serves the services registered with DefaultGateway.
 func HttpHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "Get" {
-		handleGet(w)
+	DefaultGateway.ServeHTTP(w, r)
+}
+
+// ServeHttp serves DefaultGateway on port 8082.
+//
+// Deprecated: use http.ListenAndServe with a Gateway as handler.
+func ServeHttp() {
+	http.Handle("/", DefaultGateway)
+	http.ListenAndServe(":8082", nil)
+}
+
+// writeError writes a plain text error reply.
+func (gw *Gateway) writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if gw.ServerName != "" {
+		w.Header().Set("Server", gw.ServerName)
+	}
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%d %s\n\n%s\n", status, http.StatusText(status), message)
+}
+
+func (gw *Gateway) methodAllowed(method string) bool {
+	if len(gw.AllowedMethods) == 0 {
+		return method == http.MethodPost
+	}
+	for _, allowed := range gw.AllowedMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP decodes the AMF request, calls the services and writes the reply.
+func (gw *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !gw.methodAllowed(r.Method) {
+		allowed := gw.AllowedMethods
+		if len(allowed) == 0 {
+			allowed = []string{http.MethodPost}
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		gw.writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf(
+			"To access this AMF gateway you must use %s requests (%s received)",
+			strings.Join(allowed, " or "), r.Method))
 		return
 	}
 
-	requestBundle, _ := DecodeMessageBundle(r.Body)
+	maxBodySize := gw.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			gw.writeError(w, http.StatusRequestEntityTooLarge, "Request too large")
+			return
+		}
+		gw.log(r.Context(), slog.LevelWarn, "cannot read request",
+			"remote", r.RemoteAddr, "error", err)
+		gw.writeError(w, http.StatusBadRequest, "Cannot read request")
+		return
+	}
+
+	requestBundle, err := decodeMessageBundle(bytes.NewReader(body), false, gw.Logger)
+	if err != nil {
+		gw.log(r.Context(), slog.LevelWarn, "malformed AMF request",
+			"remote", r.RemoteAddr, "error", err)
+		gw.writeError(w, http.StatusBadRequest, "Malformed AMF request")
+		return
+	}
 
-	// Initialize the reply bundle.
+	// Initialize the reply bundle. Replies are in the AMF version of the request.
 	replyBundle := MessageBundle{}
-	replyBundle.AmfVersion = 3
+	replyBundle.AmfVersion = requestBundle.AmfVersion
 	replyBundle.Messages = make([]AmfMessage, len(requestBundle.Messages))
 
-	// Construct a reply to each message.
-	for index, request := range requestBundle.Messages {
-		reply := &replyBundle.Messages[index]
-
-		replyBody, success := amfMessageHandler(request)
-		reply.Body = replyBody
-
-		/*
-		   From http://osflash.org/documentation/amf/envelopes/remoting:
+	ctx := r.Context()
+	session, err := gw.loadSession(ctx, r, requestBundle)
+	if err != nil {
+		gw.log(ctx, slog.LevelError, "cannot load session", "error", err)
+		gw.writeError(w, http.StatusInternalServerError, "Cannot load session")
+		return
+	}
+	if session != nil {
+		ctx = context.WithValue(ctx, sessionKey{}, session)
+	}
 
-		   The response to a request has the exact same structure as a request. A request
-		   requiring a body response should be answered in the following way:
+	ctx, env := gw.processHeaders(ctx, r, requestBundle.Headers)
 
-		   Target: set to Response index plus one of "/onStatus", "onResult", or
-		   "/onDebugEvents". "/onStatus" is reserved for runtime errors. "/onResult" is for
-		   succesful calls. "/onDebugEvents" is for debug information, see debug information.
-		   Thus if the client requested something with response index '/1', and the call was
-		   succesful, '/1/onResult' should be sent back. Response: should be set to the string
-		   'null'.  Data: set to the returned data.
-		*/
+	gw.replyAll(ctx, r, requestBundle, replyBundle.Messages)
+	replyBundle.Headers = env.responseHeaders()
 
-		if success {
-			reply.TargetUri = request.TargetUri + "/onResult"
-		} else {
-			reply.TargetUri = request.TargetUri + "/onStatus"
+	if session != nil {
+		if err := gw.saveSession(ctx, w, r, session); err != nil {
+			gw.log(ctx, slog.LevelError, "cannot save session", "error", err)
 		}
-		reply.ResponseUri = ""
-		fmt.Printf("writing reply to message %d, targetUri = %s", index, reply.TargetUri)
 	}
 
 	// Encode the outgoing message bundle.
 	replyBuffer := bytes.NewBuffer(make([]byte, 0))
 	encoder := NewEncoder(replyBuffer)
-	EncodeMessageBundle(encoder, &replyBundle)
+	encoder.Logger = gw.Logger
+	if err := EncodeMessageBundle(encoder, &replyBundle); err != nil {
+		gw.log(r.Context(), slog.LevelError, "cannot encode AMF reply", "error", err)
+		gw.writeError(w, http.StatusInternalServerError, "Cannot encode reply")
+		return
+	}
 	replyBytes := replyBuffer.Bytes()
-	w.Write(replyBytes)
 
 	w.Header().Set("Content-Type", "application/x-amf")
 	w.Header().Set("Content-Length", strconv.Itoa(len(replyBytes)))
-	w.Header().Set("Server", "SERVER_NAME")
+	if gw.ServerName != "" {
+		w.Header().Set("Server", gw.ServerName)
+	}
+	w.Write(replyBytes)
+}
+
+// replyAll writes the replies to the messages of a request envelope. Messages
+// are handled one at a time, unless Concurrency allows more. Command messages,
+// such as logins, wait for the messages before them, and are handled before the
+// messages after them. A panic while handling a message is raised again in the
+// calling goroutine, as it would be when handling messages one at a time.
+func (gw *Gateway) replyAll(ctx context.Context, r *http.Request, requestBundle *MessageBundle,
+	replies []AmfMessage) {
+
+	if gw.Concurrency <= 1 {
+		for index, request := range requestBundle.Messages {
+			gw.replyTo(ctx, r, requestBundle.Headers, request, &replies[index])
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	var panicOnce sync.Once
+	var panicked interface{}
+	workers := make(chan struct{}, gw.Concurrency)
+	for index, request := range requestBundle.Messages {
+		if isCommand(request) {
+			wg.Wait()
+			if panicked != nil {
+				panic(panicked)
+			}
+			gw.replyTo(ctx, r, requestBundle.Headers, request, &replies[index])
+			continue
+		}
 
-	fmt.Printf("writing reply data with length: %d", len(replyBytes))
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(request AmfMessage, reply *AmfMessage) {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					panicOnce.Do(func() { panicked = recovered })
+				}
+				<-workers
+				wg.Done()
+			}()
+			gw.replyTo(ctx, r, requestBundle.Headers, request, reply)
+		}(request, &replies[index])
+	}
+	wg.Wait()
+	if panicked != nil {
+		panic(panicked)
+	}
 }
 
-func amfMessageHandler(request AmfMessage) (data interface{}, success bool) {
-	return "hello", true
+// isCommand reports whether a request message is a CommandMessage.
+func isCommand(request AmfMessage) bool {
+	args, _ := request.Body.([]interface{})
+	if len(args) != 1 {
+		return false
+	}
+	_, ok := args[0].(FlexCommandMessage)
+	return ok
 }
 
-func ServeHttp() {
-	http.HandleFunc("/", HttpHandler)
-	http.ListenAndServe(":8082", nil)
+// replyTo answers a request message, within MessageTimeout if set.
+func (gw *Gateway) replyTo(ctx context.Context, r *http.Request, headers []Header,
+	request AmfMessage, reply *AmfMessage) {
+
+	if gw.MessageTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, gw.MessageTimeout)
+		defer cancel()
+	}
+
+	replyBody, success := gw.reply(ctx, r, headers, request)
+	reply.Body = replyBody
+
+	/*
+	   From http://osflash.org/documentation/amf/envelopes/remoting:
+
+	   The response to a request has the exact same structure as a request. A request
+	   requiring a body response should be answered in the following way:
+
+	   Target: set to Response index plus one of "/onStatus", "onResult", or
+	   "/onDebugEvents". "/onStatus" is reserved for runtime errors. "/onResult" is for
+	   succesful calls. "/onDebugEvents" is for debug information, see debug information.
+	   Thus if the client requested something with response index '/1', and the call was
+	   succesful, '/1/onResult' should be sent back. Response: should be set to the string
+	   'null'.  Data: set to the returned data.
+	*/
+
+	if success {
+		reply.TargetUri = request.ResponseUri + STATUS_CODES["STATUS_OK"]
+	} else {
+		reply.TargetUri = request.ResponseUri + STATUS_CODES["STATUS_ERROR"]
+	}
+	reply.ResponseUri = "null"
+}
+
+func (gw *Gateway) log(ctx context.Context, level slog.Level, msg string, args ...interface{}) {
+	if gw.Logger != nil {
+		gw.Logger.Log(ctx, level, msg, args...)
+	}
+}
+
+// reply returns the body of the reply to a request message, and whether the
+// request succeeded. Flex messages are answered with an AcknowledgeMessage or an
+// ErrorMessage; other requests with the result, or a status object describing
+// the error. Every message fails if the envelope headers weren't accepted.
+func (gw *Gateway) reply(ctx context.Context, r *http.Request, headers []Header,
+	request AmfMessage) (interface{}, bool) {
+
+	var headerErr error
+	if env, ok := ctx.Value(envelopeKey{}).(*envelope); ok {
+		headerErr = env.err
+	}
+
+	args, _ := request.Body.([]interface{})
+	if len(args) == 1 {
+		switch message := args[0].(type) {
+		case FlexRemotingMessage:
+			var result interface{}
+			err := headerErr
+			if err == nil {
+				call := &Call{Message: message, Headers: headers, Request: r}
+				result, err = gw.dispatch(ctx, call)
+			}
+			return flexReply(flexRequest{message.ClientId, message.MessageId,
+				message.Destination, dsIDOf(ctx, message.Headers)}, result, gw.fault(ctx, err))
+		case FlexCommandMessage:
+			var result interface{}
+			err := headerErr
+			if err == nil {
+				result, err = gw.command(ctx, message)
+			}
+			return flexReply(flexRequest{message.ClientId, message.MessageId,
+				message.Destination, dsIDOf(ctx, message.Headers)}, result, gw.fault(ctx, err))
+		}
+	}
+
+	var result interface{}
+	call, err := amf0Call(request)
+	if err == nil {
+		err = headerErr
+	}
+	if err == nil {
+		call.Headers = headers
+		call.Request = r
+		result, err = gw.dispatch(ctx, call)
+	}
+	if fault := gw.fault(ctx, err); fault != nil {
+		return map[string]interface{}{
+			"level":       "error",
+			"code":        fault.FaultCode,
+			"description": fault.FaultString,
+			"details":     fault.FaultDetail,
+		}, false
+	}
+	return result, true
+}
+
+// flexRequest holds the fields of a Flex message that its reply refers to.
+type flexRequest struct {
+	clientId    string
+	messageId   string
+	destination string
+	dsID        string
+}
+
+// dsIDOf returns the DSId of a reply: the DSId of the session, else the DSId of
+// the request, else a new one.
+func dsIDOf(ctx context.Context, headers map[string]interface{}) string {
+	if session, ok := SessionFromContext(ctx); ok {
+		return session.DSId
+	}
+	dsID, _ := headers["DSId"].(string)
+	if dsID == "" || dsID == "nil" {
+		dsID = newMessageId()
+	}
+	return dsID
+}
+
+// flexReply returns the AcknowledgeMessage carrying the result of a request, or
+// the ErrorMessage describing its fault.
+func flexReply(request flexRequest, result interface{}, fault *FaultError) (interface{}, bool) {
+	// Clients adopt the ids the server gives them.
+	clientId := request.clientId
+	if clientId == "" {
+		clientId = newMessageId()
+	}
+	headers := map[string]interface{}{"DSId": request.dsID}
+	timestamp := float64(time.Now().UnixNano() / int64(time.Millisecond))
+
+	if fault != nil {
+		return FlexErrorMessage{
+			ClientId:      clientId,
+			CorrelationId: request.messageId,
+			Destination:   request.destination,
+			Headers:       headers,
+			MessageId:     newMessageId(),
+			Timestamp:     timestamp,
+			ExtendedData:  fault.ExtendedData,
+			FaultCode:     fault.FaultCode,
+			FaultDetail:   fault.FaultDetail,
+			FaultString:   fault.FaultString,
+			RootCause:     fault.RootCause,
+		}, false
+	}
+
+	return FlexAcknowledgeMessage{
+		Body:          result,
+		ClientId:      clientId,
+		CorrelationId: request.messageId,
+		Destination:   request.destination,
+		Headers:       headers,
+		MessageId:     newMessageId(),
+		Timestamp:     timestamp,
+	}, true
+}
+
+// fault returns the fault sent to clients for err, or nil if err is nil. Errors
+// other than *FaultError become Server.Processing faults, described according to
+// the error policy.
+func (gw *Gateway) fault(ctx context.Context, err error) *FaultError {
+	if err == nil {
+		return nil
+	}
+	var fault *FaultError
+	if errors.As(err, &fault) {
+		return fault
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &FaultError{FaultCode: "Server.Processing", FaultString: "Request timed out"}
+	}
+
+	if gw.ErrorPolicy == HideErrors {
+		gw.log(ctx, slog.LevelError, "service error", "error", err)
+		return &FaultError{FaultCode: "Server.Processing", FaultString: "Internal server error"}
+	}
+	return &FaultError{FaultCode: "Server.Processing", FaultString: err.Error()}
+}
+
+// command answers a CommandMessage. Pings and other operations are simply
+// acknowledged; LOGIN checks the credentials with Authenticate and sets the user
+// of the session, giving it new ids, and LOGOUT invalidates the session.
+func (gw *Gateway) command(ctx context.Context, message FlexCommandMessage) (interface{}, error) {
+	switch message.Operation {
+	case LOGIN_OPERATION:
+		if gw.Authenticate == nil {
+			return nil, &FaultError{FaultCode: "Client.Authentication",
+				FaultString: "Login is not supported"}
+		}
+
+		text, _ := message.Body.(string)
+		credentials, err := base64.StdEncoding.DecodeString(text)
+		separator := bytes.IndexByte(credentials, ':')
+		if err != nil || separator < 0 {
+			return nil, &FaultError{FaultCode: "Client.Authentication",
+				FaultString: "Malformed credentials"}
+		}
+
+		username := string(credentials[:separator])
+		err = gw.Authenticate(ctx, username, string(credentials[separator+1:]))
+		if err != nil {
+			return nil, authenticationFault(err)
+		}
+		loginSession(ctx, username)
+		return "success", nil
+	case LOGOUT_OPERATION:
+		if session, ok := SessionFromContext(ctx); ok {
+			session.Invalidate()
+		}
+		return "success", nil
+	}
+	return nil, nil
+}
+
+// authenticationFault returns the Client.Authentication fault for an error of
+// Authenticate.
+func authenticationFault(err error) *FaultError {
+	var fault *FaultError
+	if !errors.As(err, &fault) {
+		fault = &FaultError{FaultCode: "Client.Authentication", FaultString: err.Error()}
+	}
+	return fault
 }
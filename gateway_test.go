@@ -0,0 +1,342 @@
+package amf
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testService struct {
+	prefix string
+}
+
+type testItem struct {
+	ID   int
+	Name string
+}
+
+func (s *testService) Find(ctx context.Context, id int) (testItem, error) {
+	if id == 0 {
+		return testItem{}, errors.New("not found")
+	}
+	return testItem{id, s.prefix + fmt.Sprint(id)}, nil
+}
+
+func (s *testService) Add(a, b float64) float64 {
+	return a + b
+}
+
+func (s *testService) Join(names []string, item *testItem) string {
+	return fmt.Sprint(names, item.Name)
+}
+
+func (s *testService) Reset() {
+}
+
+func TestGatewayDispatch(t *testing.T) {
+	gw := NewGateway()
+	if err := gw.Register("Items", &testService{prefix: "item"}); err != nil {
+		t.Fatalf("Register returned error: %v", err)
+	}
+	if err := gw.Register("Items", &testService{}); err == nil {
+		t.Errorf("Expected an error registering a destination twice")
+	}
+
+	ctx := context.Background()
+	flexCall := func(operation string, args ...interface{}) *Call {
+		return &Call{Message: FlexRemotingMessage{Destination: "Items", Operation: operation,
+			Body: args}}
+	}
+	targetCall := func(target string, args ...interface{}) *Call {
+		call, err := amf0Call(AmfMessage{TargetUri: target, ResponseUri: "/1", Body: args})
+		if err != nil {
+			t.Fatalf("amf0Call(%s) returned error: %v", target, err)
+		}
+		return call
+	}
+
+	result, err := gw.dispatch(ctx, flexCall("find", uint32(7)))
+	if item, ok := result.(testItem); err != nil || !ok || item.Name != "item7" {
+		t.Errorf("find returned %v, %v", result, err)
+	}
+	if _, err := gw.dispatch(ctx, flexCall("find", 0)); err == nil || err.Error() != "not found" {
+		t.Errorf("Expected the error of the method, got %v", err)
+	}
+	result, err = gw.dispatch(ctx, flexCall("join", []interface{}{"a", "b"},
+		map[string]interface{}{"name": "c"}))
+	if err != nil || result != "[a b]c" {
+		t.Errorf("join returned %v, %v", result, err)
+	}
+	if result, err := gw.dispatch(ctx, flexCall("Reset")); err != nil || result != nil {
+		t.Errorf("Reset returned %v, %v", result, err)
+	}
+
+	// AMF0 call by target URI.
+	result, err = gw.dispatch(ctx, targetCall("Items.add", 1.5, uint32(2)))
+	if err != nil || result != 3.5 {
+		t.Errorf("add returned %v, %v", result, err)
+	}
+
+	for _, call := range []*Call{
+		flexCall("find"),
+		flexCall("find", "seven"),
+		flexCall("remove", 1),
+		targetCall("Other.add", 1, 2),
+	} {
+		if _, err := gw.dispatch(ctx, call); err == nil {
+			t.Errorf("Expected an error for %+v", call.Message)
+		}
+	}
+	if _, err := amf0Call(AmfMessage{TargetUri: "add", Body: []interface{}{1, 2}}); err == nil {
+		t.Errorf("Expected an error for a target without operation")
+	}
+}
+
+func TestGatewayReplies(t *testing.T) {
+	gw := NewGateway()
+	gw.Register("Items", &testService{prefix: "item"})
+	gw.Authenticate = func(ctx context.Context, username, password string) error {
+		if password != "secret" {
+			return errors.New("wrong password")
+		}
+		return nil
+	}
+	server := httptest.NewServer(gw)
+	defer server.Close()
+
+	ctx := context.Background()
+	client := NewClient(server.URL)
+
+	var item testItem
+	if err := client.Call(ctx, "Items", "find", &item, 3); err != nil || item.Name != "item3" {
+		t.Errorf("find returned %+v, %v", item, err)
+	}
+	if client.DSId() == "" {
+		t.Errorf("The gateway didn't assign a DSId")
+	}
+
+	var fault *FaultError
+	err := client.Call(ctx, "Items", "find", &item, 0)
+	if !errors.As(err, &fault) || fault.FaultCode != "Server.Processing" ||
+		fault.FaultString != "not found" {
+		t.Errorf("Expected a Server.Processing fault, got %v", err)
+	}
+
+	if err := client.Login(ctx, "sam", "wrong"); !errors.As(err, &fault) ||
+		fault.FaultCode != "Client.Authentication" {
+		t.Errorf("Expected a Client.Authentication fault, got %v", err)
+	}
+	if err := client.Login(ctx, "sam", "secret"); err != nil {
+		t.Errorf("Login returned error: %v", err)
+	}
+	if err := client.Logout(ctx); err != nil {
+		t.Errorf("Logout returned error: %v", err)
+	}
+
+	// Acknowledgements refer to their request.
+	requestMessage := FlexRemotingMessage{MessageId: "M1", ClientId: "C1", Destination: "Items",
+		Operation: "add", Body: []interface{}{1, 2}}
+	body, ok := gw.reply(ctx, nil, nil, AmfMessage{TargetUri: "null", ResponseUri: "/1",
+		Body: []interface{}{requestMessage}})
+	ack, isAck := body.(FlexAcknowledgeMessage)
+	if !ok || !isAck || ack.CorrelationId != "M1" || ack.ClientId != "C1" ||
+		ack.Destination != "Items" || ack.Body != 3.0 || ack.Timestamp == 0 {
+		t.Errorf("Wrong acknowledgement: %+v", body)
+	}
+
+	// AMF0 requests get AMF0 replies.
+	bundle := MessageBundle{AmfVersion: 0, Messages: []AmfMessage{
+		{TargetUri: "Items.add", ResponseUri: "/1", Body: []interface{}{1, 2}}}}
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	EncodeMessageBundle(NewEncoder(buffer), &bundle)
+	response, err := http.Post(server.URL, "application/x-amf", buffer)
+	if err != nil {
+		t.Fatalf("Post returned error: %v", err)
+	}
+	defer response.Body.Close()
+	reply, err := DecodeMessageBundle(response.Body)
+	if err != nil || reply.AmfVersion != 0 || len(reply.Messages) != 1 ||
+		reply.Messages[0].TargetUri != "/1/onResult" || reply.Messages[0].Body != 3.0 {
+		t.Errorf("Wrong AMF0 reply: %+v (%v)", reply, err)
+	}
+}
+
+func TestGatewayHTTP(t *testing.T) {
+	gw := NewGateway()
+	gw.Register("Items", &testService{prefix: "item"})
+	gw.ServerName = "test"
+	gw.MaxBodySize = 64
+	gw.ErrorPolicy = HideErrors
+	server := httptest.NewServer(gw)
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed || response.Header.Get("Allow") != "POST" {
+		t.Errorf("Expected 405 with Allow: POST, got %d %q", response.StatusCode,
+			response.Header.Get("Allow"))
+	}
+
+	response, err = http.Post(server.URL, "application/x-amf", strings.NewReader("\x00"))
+	if err != nil {
+		t.Fatalf("Post returned error: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed request, got %d", response.StatusCode)
+	}
+
+	bundle := MessageBundle{AmfVersion: 0, Messages: []AmfMessage{
+		{TargetUri: "Items.find", ResponseUri: "/1", Body: []interface{}{strings.Repeat("x", 100)}}}}
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	EncodeMessageBundle(NewEncoder(buffer), &bundle)
+	response, err = http.Post(server.URL, "application/x-amf", buffer)
+	if err != nil {
+		t.Fatalf("Post returned error: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a large request, got %d", response.StatusCode)
+	}
+
+	bundle = MessageBundle{AmfVersion: 0, Messages: []AmfMessage{
+		{TargetUri: "Items.find", ResponseUri: "/1", Body: []interface{}{0}}}}
+	buffer = bytes.NewBuffer(make([]byte, 0))
+	EncodeMessageBundle(NewEncoder(buffer), &bundle)
+	response, err = http.Post(server.URL, "application/x-amf", buffer)
+	if err != nil {
+		t.Fatalf("Post returned error: %v", err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "application/x-amf" ||
+		response.Header.Get("Server") != "test" || response.ContentLength <= 0 {
+		t.Errorf("Wrong reply headers: %v", response.Header)
+	}
+	reply, err := DecodeMessageBundle(response.Body)
+	if err != nil || len(reply.Messages) != 1 {
+		t.Fatalf("Wrong reply: %+v (%v)", reply, err)
+	}
+	status, _ := reply.Messages[0].Body.(map[string]interface{})
+	if reply.Messages[0].TargetUri != "/1/onStatus" ||
+		status["description"] != "Internal server error" {
+		t.Errorf("Expected a hidden error, got %+v", reply.Messages[0])
+	}
+}
+
+type testLoops struct{}
+
+func (testLoops) Count(loop testLoop) int {
+	return len(loop.Next)
+}
+
+func (testLoops) Name(node *testNode) string {
+	return node.Next.Name
+}
+
+func TestGatewayCyclicArguments(t *testing.T) {
+	gw := NewGateway()
+	gw.Register("Loops", testLoops{})
+	server := httptest.NewServer(gw)
+	defer server.Close()
+
+	call := func(target, arg string) AmfMessage {
+		// An AMF0 envelope whose argument is an AMF3 object.
+		request, _ := hex.DecodeString(fmt.Sprintf("000300000001%04x%x00022f3100000000"+
+			"0a0000000111%s", len(target), target, arg))
+		response, err := http.Post(server.URL, "application/x-amf", bytes.NewReader(request))
+		if err != nil {
+			t.Fatalf("Post returned error: %v", err)
+		}
+		defer response.Body.Close()
+		reply, err := DecodeMessageBundle(response.Body)
+		if err != nil || len(reply.Messages) != 1 {
+			t.Fatalf("Wrong reply: %+v (%v)", reply, err)
+		}
+		return reply.Messages[0]
+	}
+
+	// An object whose next member is an array holding the object.
+	reply := call("Loops.count", "0a0b01096e6578740903010a0001")
+	if reply.TargetUri != "/1/onStatus" {
+		t.Errorf("Expected a fault for a cyclic argument, got %+v", reply)
+	}
+	// An object whose next member is the object itself.
+	reply = call("Loops.name", "0a0b01096e616d65060361096e6578740a0001")
+	if reply.TargetUri != "/1/onResult" || reply.Body != "a" {
+		t.Errorf("Expected the name of the next node, got %+v", reply)
+	}
+}
+
+type testSleeper struct {
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (s *testSleeper) Sleep(ctx context.Context, ms int) (int, error) {
+	s.mu.Lock()
+	s.running++
+	if s.running > s.max {
+		s.max = s.running
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running--
+		s.mu.Unlock()
+	}()
+
+	select {
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		return ms, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func TestGatewayConcurrency(t *testing.T) {
+	sleeper := &testSleeper{}
+	gw := NewGateway()
+	gw.Register("Sleeper", sleeper)
+	gw.Concurrency = 2
+	gw.MessageTimeout = time.Second
+	server := httptest.NewServer(gw)
+	defer server.Close()
+	ctx := context.Background()
+	client := NewClient(server.URL)
+
+	results := make([]int, 5)
+	batch := client.Batch()
+	for i := range results {
+		batch.Add("Sleeper", "sleep", &results[i], 50-i*10)
+	}
+	if _, err := batch.Do(ctx); err != nil {
+		t.Fatalf("Batch returned error: %v", err)
+	}
+	for i, result := range results {
+		if result != 50-i*10 {
+			t.Errorf("Wrong result %d: %d", i, result)
+		}
+	}
+	if sleeper.max != 2 {
+		t.Errorf("Expected 2 messages at once, got %d", sleeper.max)
+	}
+
+	gw.MessageTimeout = 10 * time.Millisecond
+	var fault *FaultError
+	if err := client.Call(ctx, "Sleeper", "sleep", nil, 1000); !errors.As(err, &fault) ||
+		fault.FaultString != "Request timed out" {
+		t.Errorf("Expected a timeout fault, got %v", err)
+	}
+}
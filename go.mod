@@ -1,3 +1,5 @@
 module github.com/kumakichi/goamf
 
+go 1.21
+
 require github.com/google/uuid v0.0.0-20161128191214-064e2069ce9c
@@ -0,0 +1,134 @@
+package amf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// HeaderHandler processes a header of a request envelope, before the messages of
+// the envelope are dispatched. It returns the context the messages are
+// dispatched with, which can carry what the header told, such as the user of a
+// Credentials header. An error fails every message of the envelope.
+type HeaderHandler func(ctx context.Context, r *http.Request, header Header) (context.Context, error)
+
+// HandleHeader registers the handler of the headers named name. Headers with no
+// handler are ignored, unless their MustUnderstand flag is set, which fails the
+// envelope with a Client.Header.MustUnderstand fault.
+//
+// Without a handler for Credentials, the gateway checks Credentials headers with
+// Authenticate, if set.
+func (gw *Gateway) HandleHeader(name string, handler HeaderHandler) {
+	if gw.headerHandlers == nil {
+		gw.headerHandlers = make(map[string]HeaderHandler)
+	}
+	gw.headerHandlers[name] = handler
+}
+
+// envelope holds the state of a request envelope shared by its messages.
+type envelope struct {
+	// err fails every message, when the headers weren't accepted.
+	err error
+
+	mu      sync.Mutex
+	headers []Header
+}
+
+type envelopeKey struct{}
+
+// AddResponseHeader adds a header to the reply envelope of the call being
+// handled, such as AppendToGatewayUrl with a suffix for the URL of the following
+// requests. See also RequestPersistentHeader.
+func AddResponseHeader(ctx context.Context, header Header) error {
+	env, ok := ctx.Value(envelopeKey{}).(*envelope)
+	if !ok {
+		return errors.New("AddResponseHeader called outside of a gateway call")
+	}
+
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	for i := range env.headers {
+		if env.headers[i].Name == header.Name {
+			env.headers[i] = header
+			return nil
+		}
+	}
+	env.headers = append(env.headers, header)
+	return nil
+}
+
+// RequestPersistentHeader asks the client to send header with all its following
+// requests.
+func RequestPersistentHeader(ctx context.Context, header Header) error {
+	return AddResponseHeader(ctx, Header{Name: "RequestPersistentHeader", Value: map[string]interface{}{
+		"name":           header.Name,
+		"mustUnderstand": header.MustUnderstand,
+		"data":           header.Value,
+	}})
+}
+
+// responseHeaders returns the headers added to the reply envelope.
+func (env *envelope) responseHeaders() []Header {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return env.headers
+}
+
+// processHeaders runs the header handlers on the headers of a request envelope,
+// and returns the context for its messages, which holds the envelope.
+func (gw *Gateway) processHeaders(ctx context.Context, r *http.Request,
+	headers []Header) (context.Context, *envelope) {
+
+	env := &envelope{}
+	ctx = context.WithValue(ctx, envelopeKey{}, env)
+
+	for _, header := range headers {
+		handler, ok := gw.headerHandlers[header.Name]
+		if !ok && header.Name == "Credentials" && gw.Authenticate != nil {
+			handler, ok = gw.checkCredentials, true
+		}
+		if !ok {
+			if header.MustUnderstand {
+				env.err = &FaultError{FaultCode: "Client.Header.MustUnderstand",
+					FaultString: fmt.Sprintf("Header not understood: %s", header.Name)}
+				return ctx, env
+			}
+			continue
+		}
+
+		next, err := handler(ctx, r, header)
+		if err != nil {
+			env.err = err
+			return ctx, env
+		}
+		if next != nil {
+			ctx = next
+		}
+	}
+	return ctx, env
+}
+
+// checkCredentials checks the {userid, password} value of a Credentials header
+// with Authenticate. The session gets new ids when its user changes.
+func (gw *Gateway) checkCredentials(ctx context.Context, r *http.Request,
+	header Header) (context.Context, error) {
+
+	var credentials struct {
+		UserID   string `amf:"userid"`
+		Password string `amf:"password"`
+	}
+	if err := assignValue(reflect.ValueOf(&credentials).Elem(), header.Value); err != nil {
+		return nil, &FaultError{FaultCode: "Client.Authentication",
+			FaultString: "Malformed credentials"}
+	}
+	if err := gw.Authenticate(ctx, credentials.UserID, credentials.Password); err != nil {
+		return nil, authenticationFault(err)
+	}
+	if session, ok := SessionFromContext(ctx); ok && session.User() != credentials.UserID {
+		loginSession(ctx, credentials.UserID)
+	}
+	return ctx, nil
+}
@@ -0,0 +1,105 @@
+package amf
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type localeKey struct{}
+
+type testGreeter struct{}
+
+func (testGreeter) Greet(ctx context.Context) (string, error) {
+	locale, _ := ctx.Value(localeKey{}).(string)
+	if err := AddResponseHeader(ctx, Header{Name: "AppendToGatewayUrl", Value: ";s=1"}); err != nil {
+		return "", err
+	}
+	err := RequestPersistentHeader(ctx, Header{Name: "Locale", Value: locale})
+	return "hello " + locale, err
+}
+
+func TestGatewayHeaders(t *testing.T) {
+	gw := NewGateway()
+	gw.Register("Greeter", testGreeter{})
+	gw.Authenticate = func(ctx context.Context, username, password string) error {
+		if password != "secret" {
+			return errors.New("wrong password")
+		}
+		return nil
+	}
+	gw.HandleHeader("Locale", func(ctx context.Context, r *http.Request,
+		header Header) (context.Context, error) {
+		locale, _ := header.Value.(string)
+		return context.WithValue(ctx, localeKey{}, locale), nil
+	})
+	server := httptest.NewServer(gw)
+	defer server.Close()
+	ctx := context.Background()
+
+	// Credentials headers are checked with Authenticate.
+	client := NewClient(server.URL)
+	client.SetCredentials("sam", "wrong")
+	var fault *FaultError
+	if err := client.Call(ctx, "Greeter", "greet", nil); !errors.As(err, &fault) ||
+		fault.FaultCode != "Client.Authentication" {
+		t.Errorf("Expected a Client.Authentication fault, got %v", err)
+	}
+	client.SetCredentials("sam", "secret")
+	var greeting string
+	if err := client.Call(ctx, "Greeter", "greet", &greeting); err != nil {
+		t.Errorf("greet returned error: %v", err)
+	}
+	if !strings.HasSuffix(client.gatewayURL(), ";s=1") {
+		t.Errorf("AppendToGatewayUrl wasn't sent: %s", client.gatewayURL())
+	}
+
+	post := func(headers ...Header) *MessageBundle {
+		bundle := MessageBundle{AmfVersion: 0, Headers: headers, Messages: []AmfMessage{
+			{TargetUri: "Greeter.greet", ResponseUri: "/1", Body: []interface{}{}}}}
+		buffer := bytes.NewBuffer(make([]byte, 0))
+		EncodeMessageBundle(NewEncoder(buffer), &bundle)
+		response, err := http.Post(server.URL, "application/x-amf", buffer)
+		if err != nil {
+			t.Fatalf("Post returned error: %v", err)
+		}
+		defer response.Body.Close()
+		reply, err := DecodeMessageBundle(response.Body)
+		if err != nil || len(reply.Messages) != 1 {
+			t.Fatalf("Wrong reply: %+v (%v)", reply, err)
+		}
+		return reply
+	}
+
+	// Custom handlers pass what headers tell to the services, which can answer
+	// with headers.
+	reply := post(Header{Name: "Locale", MustUnderstand: true, Value: "fr"})
+	if reply.Messages[0].Body != "hello fr" {
+		t.Errorf("Wrong reply to a call with a custom header: %+v", reply.Messages[0])
+	}
+	var persistent map[string]interface{}
+	for _, header := range reply.Headers {
+		if header.Name == "RequestPersistentHeader" {
+			persistent, _ = header.Value.(map[string]interface{})
+		}
+	}
+	if persistent["name"] != "Locale" || persistent["data"] != "fr" {
+		t.Errorf("Wrong RequestPersistentHeader: %+v", reply.Headers)
+	}
+
+	// Headers that must be understood can't be ignored.
+	reply = post(Header{Name: "Unknown", Value: 1.0})
+	if reply.Messages[0].TargetUri != "/1/onResult" {
+		t.Errorf("Expected an optional header to be ignored: %+v", reply.Messages[0])
+	}
+	reply = post(Header{Name: "Unknown", MustUnderstand: true, Value: 1.0})
+	status, _ := reply.Messages[0].Body.(map[string]interface{})
+	if reply.Messages[0].TargetUri != "/1/onStatus" ||
+		status["code"] != "Client.Header.MustUnderstand" {
+		t.Errorf("Expected a MustUnderstand fault: %+v", reply.Messages[0])
+	}
+}
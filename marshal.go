@@ -0,0 +1,239 @@
+package amf
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Marshaler is implemented by types that write their own AMF representation.
+// MarshalAMF must write one complete value, type marker included, using the
+// encoder's Write methods. Calling WriteValue from MarshalAMF writes in the AMF
+// version of the value being encoded.
+type Marshaler interface {
+	MarshalAMF(cxt *Encoder) error
+}
+
+// Unmarshaler is implemented by types that read their own AMF representation.
+//
+// UnmarshalAMF is called by Decoder.Decode to read one complete value. It is also
+// called for registered types whose class is externalizable: then the class
+// definition has already been read, and UnmarshalAMF reads the externalized
+// data, as readExternal does in ActionScript.
+type Unmarshaler interface {
+	UnmarshalAMF(cxt *Decoder) error
+}
+
+// ValueMarshaler is a simpler alternative to Marshaler: the type returns another
+// value (a string, a number, a map...) which is encoded in its place.
+type ValueMarshaler interface {
+	MarshalAMFValue() (interface{}, error)
+}
+
+// ValueUnmarshaler is a simpler alternative to Unmarshaler: the type receives
+// the decoded value. For registered types this is the AvmObject read from the
+// stream.
+type ValueUnmarshaler interface {
+	UnmarshalAMFValue(value interface{}) error
+}
+
+var (
+	marshalerType        = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType      = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	valueMarshalerType   = reflect.TypeOf((*ValueMarshaler)(nil)).Elem()
+	valueUnmarshalerType = reflect.TypeOf((*ValueUnmarshaler)(nil)).Elem()
+	textMarshalerType    = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType  = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	timeType             = reflect.TypeOf(time.Time{})
+)
+
+// Decode reads the next value into the value pointed to by v. AMF3 is used if the
+// decoder was created for AMF version 3 or has switched to AMF3, AMF0 otherwise.
+func (cxt *Decoder) Decode(v interface{}) error {
+	if cxt.errored() {
+		return cxt.decodeError
+	}
+
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return errors.New("Decode requires a non-nil pointer")
+	}
+
+	if unmarshaler, ok := v.(Unmarshaler); ok {
+		err := unmarshaler.UnmarshalAMF(cxt)
+		if err == nil {
+			err = cxt.decodeError
+		}
+		return err
+	}
+
+	var value interface{}
+	if cxt.IsAMF3 || cxt.useAmf3() {
+		value = cxt.ReadValueAmf3()
+	} else {
+		value = cxt.ReadValue()
+	}
+	if cxt.errored() {
+		return cxt.decodeError
+	}
+
+	return assignValue(target.Elem(), value)
+}
+
+// WriteValue writes a value in the encoder's AMF version.
+func (cxt *Encoder) WriteValue(value interface{}) error {
+	if cxt.AmfVersion == 3 {
+		return cxt.WriteValueAmf3(value)
+	}
+	return cxt.WriteValueAmf0(value)
+}
+
+// findMarshaler returns the Marshaler or ValueMarshaler implemented by value, or
+// by a pointer to it.
+func findMarshaler(value reflect.Value) (Marshaler, ValueMarshaler) {
+	if marshaler, ok := findInterface(value, marshalerType); ok {
+		return marshaler.(Marshaler), nil
+	}
+	if marshaler, ok := findInterface(value, valueMarshalerType); ok {
+		return nil, marshaler.(ValueMarshaler)
+	}
+	return nil, nil
+}
+
+// findInterface returns value, or a pointer to it, as an implementation of iface.
+func findInterface(value reflect.Value, iface reflect.Type) (interface{}, bool) {
+	if !value.IsValid() {
+		return nil, false
+	}
+	if (value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface) && value.IsNil() {
+		return nil, false
+	}
+	if value.CanInterface() && value.Type().Implements(iface) {
+		return value.Interface(), true
+	}
+	if value.Kind() != reflect.Ptr && value.CanAddr() && value.Addr().CanInterface() &&
+		value.Addr().Type().Implements(iface) {
+		return value.Addr().Interface(), true
+	}
+	return nil, false
+}
+
+// mapKeyString returns the member name used for a map key: strings as they are,
+// encoding.TextMarshaler implementations as text, and numbers formatted in
+// decimal, as encoding/json does. fmt.Stringer is not used, as the decoder
+// couldn't parse such keys back.
+func mapKeyString(key reflect.Value) (string, error) {
+	if key.Kind() == reflect.String {
+		return key.String(), nil
+	}
+	if marshaler, ok := findInterface(key, textMarshalerType); ok {
+		text, err := marshaler.(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+
+	switch key.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(key.Float(), 'g', -1, key.Type().Bits()), nil
+	case reflect.Interface, reflect.Ptr:
+		if !key.IsNil() {
+			return mapKeyString(key.Elem())
+		}
+	}
+
+	return "", errors.New(fmt.Sprintf("unsupported map key type: %v", key.Type()))
+}
+
+// writeMarshaler lets value encode itself, if it knows how. It reports whether
+// value implemented one of the marshaling interfaces. Values of type time.Time
+// are written as dates, and other encoding.TextMarshaler implementations as
+// strings.
+func (cxt *Encoder) writeMarshaler(value reflect.Value, amfVersion uint16) (bool, error) {
+	marshaler, valueMarshaler := findMarshaler(value)
+
+	if marshaler != nil {
+		saved := cxt.AmfVersion
+		cxt.AmfVersion = amfVersion
+		err := marshaler.MarshalAMF(cxt)
+		cxt.AmfVersion = saved
+		return true, err
+	}
+
+	if valueMarshaler != nil {
+		replacement, err := valueMarshaler.MarshalAMFValue()
+		if err != nil {
+			return true, err
+		}
+		if amfVersion == 3 {
+			return true, cxt.WriteValueAmf3(replacement)
+		}
+		return true, cxt.WriteValueAmf0(replacement)
+	}
+
+	if value.IsValid() && value.Type() == timeType && value.CanInterface() {
+		return true, cxt.writeDate(value.Interface().(time.Time), amfVersion)
+	}
+
+	if marshaler, ok := findInterface(value, textMarshalerType); ok {
+		text, err := marshaler.(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return true, err
+		}
+		if amfVersion == 3 {
+			return true, cxt.WriteValueAmf3(string(text))
+		}
+		return true, cxt.WriteValueAmf0(string(text))
+	}
+
+	return false, nil
+}
+
+// writeDate writes a date as milliseconds since the epoch, in UTC.
+func (cxt *Encoder) writeDate(t time.Time, amfVersion uint16) error {
+	ms := float64(t.Unix())*1000 + float64(t.Nanosecond()/int(time.Millisecond))
+	if amfVersion == 3 {
+		cxt.writeByte(amf3_dateType)
+		cxt.writeObjectReference(nil)
+		cxt.WriteUint29(REFERENCE_BIT)
+		return cxt.WriteFloat64(ms)
+	}
+
+	cxt.writeByte(amf0_dateType)
+	cxt.WriteFloat64(ms)
+	// Time zone, which is ignored by readers.
+	return cxt.WriteUint16(0)
+}
+
+// readUnmarshaler reads an externalizable object of a registered type that
+// implements Unmarshaler. It reports false if goType doesn't.
+func (cxt *Decoder) readUnmarshaler(goType reflect.Type) (interface{}, bool) {
+	if !reflect.PtrTo(goType).Implements(unmarshalerType) {
+		return nil, false
+	}
+
+	result := reflect.New(goType)
+
+	// Store the object in the table before doing any decoding.
+	index := len(cxt.objectTable)
+	cxt.storeObjectInTable(result.Interface())
+
+	err := result.Interface().(Unmarshaler).UnmarshalAMF(cxt)
+	cxt.saveError(err)
+
+	cxt.objectTable[index] = result.Elem().Interface()
+	return result.Elem().Interface(), true
+}
+
+// interfaceOf returns the value held by v, or nil if it can't be accessed.
+func interfaceOf(v reflect.Value) interface{} {
+	if !v.IsValid() || !v.CanInterface() {
+		return nil
+	}
+	return v.Interface()
+}
@@ -0,0 +1,260 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Written as its string form, like BlazeDS does for java.math.BigDecimal.
+type testDecimal struct {
+	text string
+}
+
+func (d testDecimal) MarshalAMFValue() (interface{}, error) {
+	return d.text, nil
+}
+
+func (d *testDecimal) UnmarshalAMFValue(value interface{}) error {
+	s, ok := value.(string)
+	if !ok {
+		return errors.New("decimal must be a string")
+	}
+	d.text = s
+	return nil
+}
+
+// Written as an integer through the encoder.
+type testEnum int
+
+func (e testEnum) MarshalAMF(cxt *Encoder) error {
+	return cxt.WriteValue(int(e) * 10)
+}
+
+func (e *testEnum) UnmarshalAMF(cxt *Decoder) error {
+	var value int
+	if err := cxt.Decode(&value); err != nil {
+		return err
+	}
+	*e = testEnum(value / 10)
+	return nil
+}
+
+// An externalizable class that writes its value as a string.
+type testExternal struct {
+	value int
+}
+
+func (e *testExternal) UnmarshalAMF(cxt *Decoder) error {
+	s, _ := cxt.ReadValueAmf3().(string)
+	value, err := strconv.Atoi(s)
+	e.value = value
+	return err
+}
+
+// Reads itself from a decoded object.
+type testPoint struct {
+	x float64
+}
+
+func (p *testPoint) UnmarshalAMFValue(value interface{}) error {
+	object, ok := value.(AvmObject)
+	if !ok {
+		return errors.New("point must be an object")
+	}
+	p.x, _ = object.StaticFields["x"].(float64)
+	return nil
+}
+
+func testWriteAmf0(t *testing.T, value interface{}, expectedBlob string) {
+	writer := bytes.NewBuffer(make([]byte, 0, 1))
+
+	err := NewEncoder(writer).WriteValueAmf0(value)
+
+	if hex.EncodeToString(writer.Bytes()) != expectedBlob {
+		t.Errorf("Write result of '%x' didn't match expected '%s' for input %v",
+			writer.Bytes(), expectedBlob, value)
+	}
+	if err != nil {
+		t.Errorf("Received error while trying to write '%v': %v", value, err)
+	}
+}
+
+func TestMarshalers(t *testing.T) {
+	testWriteAmf3(t, testDecimal{"1.5"}, "0607312e35")
+	testWriteAmf3(t, []interface{}{testDecimal{"2"}}, "090301060332")
+	testWriteAmf3(t, testEnum(3), "041e")
+	testWriteAmf3(t, new(testEnum), "0400")
+
+	testWriteAmf0(t, testDecimal{"1.5"}, "020003312e35")
+	testWriteAmf0(t, testEnum(3), "00403e000000000000")
+}
+
+func TestUnmarshalers(t *testing.T) {
+	blob, _ := hex.DecodeString("0607312e35041e")
+	cxt := NewDecoder(bytes.NewBuffer(blob), 3)
+
+	var decimal testDecimal
+	if err := cxt.Decode(&decimal); err != nil || decimal.text != "1.5" {
+		t.Errorf("Decode into ValueUnmarshaler returned %v, %v", decimal, err)
+	}
+	var enum testEnum
+	if err := cxt.Decode(&enum); err != nil || enum != 3 {
+		t.Errorf("Decode into Unmarshaler returned %v, %v", enum, err)
+	}
+
+	// Same values in AMF0.
+	blob, _ = hex.DecodeString("020003312e3500403e000000000000")
+	cxt = NewDecoder(bytes.NewBuffer(blob), 0)
+	if err := cxt.Decode(&decimal); err != nil || decimal.text != "1.5" {
+		t.Errorf("AMF0 Decode into ValueUnmarshaler returned %v, %v", decimal, err)
+	}
+	if err := cxt.Decode(&enum); err != nil || enum != 3 {
+		t.Errorf("AMF0 Decode into Unmarshaler returned %v, %v", enum, err)
+	}
+}
+
+func TestUnmarshalRegisteredTypes(t *testing.T) {
+	// Externalizable class "Ext" followed by its data, then a reference to it.
+	blob, _ := hex.DecodeString("0905010a0707457874060534320a02")
+	cxt := NewDecoder(bytes.NewBuffer(blob), 3)
+	cxt.RegisterType("Ext", testExternal{})
+
+	value := cxt.ReadValueAmf3()
+	if cxt.decodeError != nil {
+		t.Fatalf("Received error while reading externalizable object: %v", cxt.decodeError)
+	}
+	array, _ := value.([]interface{})
+	if len(array) != 2 {
+		t.Fatalf("Expected an array of 2, got %v", value)
+	}
+	if ext, ok := array[0].(testExternal); !ok || ext.value != 42 {
+		t.Errorf("Wrong externalizable value: %v", array[0])
+	}
+	if ext, ok := array[1].(testExternal); !ok || ext.value != 42 {
+		t.Errorf("Wrong reference to externalizable value: %v", array[1])
+	}
+
+	// AMF0 typed object "Point" {x: 2} into a ValueUnmarshaler.
+	blob, _ = hex.DecodeString("100005506f696e74000178004000000000000000000009")
+	cxt = NewDecoder(bytes.NewBuffer(blob), 0)
+	cxt.RegisterType("Point", testPoint{})
+	value = cxt.ReadValue()
+	if point, ok := value.(testPoint); !ok || point.x != 2 {
+		t.Errorf("Wrong typed object: %v (%v)", value, cxt.decodeError)
+	}
+}
+
+// A fixed-size identifier with a text form, like uuid.UUID.
+type testID [4]byte
+
+func (id testID) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(id[:])), nil
+}
+
+func (id *testID) UnmarshalText(text []byte) error {
+	_, err := hex.Decode(id[:], text)
+	return err
+}
+
+func TestTextMarshalers(t *testing.T) {
+	testWriteAmf3(t, testID{1, 2, 3, 4}, "06113031303230333034")
+	testWriteAmf3(t, map[int]string{7: "a"}, "0a0b01033706036101")
+	testWriteAmf3(t, map[testID]int{{1, 2, 3, 4}: 1}, "0a0b01113031303230333034040101")
+	testWriteAmf3(t, time.Unix(1, 0), "0801408f400000000000")
+
+	testWriteAmf0(t, testID{1, 2, 3, 4}, "0200083031303230333034")
+	testWriteAmf0(t, map[int]string{7: "a"}, "0300013702000161000009")
+	testWriteAmf0(t, time.Unix(1, 0), "0b408f4000000000000000")
+
+	blob, _ := hex.DecodeString("0a0b01033706036101" +
+		"0a0b0111303130323033303406037801" +
+		"06113031303230333034")
+	cxt := NewDecoder(bytes.NewBuffer(blob), 3)
+
+	var byNumber map[int]string
+	if err := cxt.Decode(&byNumber); err != nil || byNumber[7] != "a" {
+		t.Errorf("Decode into map[int]string returned %v, %v", byNumber, err)
+	}
+	var byID map[testID]string
+	if err := cxt.Decode(&byID); err != nil || byID[testID{1, 2, 3, 4}] != "x" {
+		t.Errorf("Decode into map[testID]string returned %v, %v", byID, err)
+	}
+	var id testID
+	if err := cxt.Decode(&id); err != nil || id != (testID{1, 2, 3, 4}) {
+		t.Errorf("Decode into TextUnmarshaler returned %v, %v", id, err)
+	}
+}
+
+// An enum with a String method, which map keys don't use.
+type testColor int
+
+func (c testColor) String() string {
+	return []string{"red", "green", "blue"}[c]
+}
+
+func TestAmf0Dates(t *testing.T) {
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := NewEncoder(buffer).WriteValueAmf0([]interface{}{time.Unix(1, 0), "after"}); err != nil {
+		t.Fatalf("Received error while writing: %v", err)
+	}
+	cxt := NewDecoder(buffer, 0)
+	value := cxt.ReadValue()
+	array, _ := value.([]interface{})
+	if cxt.decodeError != nil || len(array) != 2 || array[1] != "after" {
+		t.Fatalf("Wrong values after a date: %v (%v)", value, cxt.decodeError)
+	}
+	if date, ok := array[0].(time.Time); !ok || !date.Equal(time.Unix(1, 0)) {
+		t.Errorf("Wrong date: %v", array[0])
+	}
+
+	// Markers that can't be decoded stop decoding.
+	cxt = NewDecoder(bytes.NewBuffer([]byte{0x04, 0x00}), 0)
+	if cxt.ReadValue(); cxt.decodeError == nil {
+		t.Errorf("Expected an error for an unsupported marker")
+	}
+}
+
+func TestAmf0Cycles(t *testing.T) {
+	node := &testNode{Name: "a"}
+	node.Next = node
+	if err := NewEncoder(new(bytes.Buffer)).WriteValueAmf0(node); err == nil {
+		t.Errorf("Expected an error writing a cycle in AMF0")
+	}
+	cycle := map[string]interface{}{}
+	cycle["self"] = cycle
+	if err := NewEncoder(new(bytes.Buffer)).WriteValueAmf0(cycle); err == nil {
+		t.Errorf("Expected an error writing a cycle in AMF0")
+	}
+
+	// Values met twice without a cycle are written twice.
+	shared := &testNode{Name: "b"}
+	if err := NewEncoder(new(bytes.Buffer)).WriteValueAmf0([]*testNode{shared, shared}); err != nil {
+		t.Errorf("WriteValueAmf0 returned error: %v", err)
+	}
+}
+
+func TestAmf0LongStrings(t *testing.T) {
+	cxt := NewDecoder(bytes.NewBuffer([]byte{0x0c, 0, 0, 0, 2, 'h', 'i'}), 0)
+	if value := cxt.ReadValue(); cxt.decodeError != nil || value != "hi" {
+		t.Errorf("Long string decoded as %v (%v)", value, cxt.decodeError)
+	}
+
+	// The length of truncated strings isn't allocated.
+	cxt = NewDecoder(bytes.NewBuffer([]byte{0x0c, 0xff, 0xff, 0xff, 0xff, 'h', 'i'}), 0)
+	if cxt.ReadValue(); cxt.decodeError == nil {
+		t.Errorf("Expected an error for a truncated long string")
+	}
+}
+
+func TestStringerMapKeys(t *testing.T) {
+	testWriteAmf3(t, map[testColor]int{2: 1}, "0a0b010332040101")
+	blob, _ := hex.DecodeString("0a0b010332040101")
+	var colors map[testColor]int
+	if err := NewDecoder(bytes.NewBuffer(blob), 3).Decode(&colors); err != nil || colors[2] != 1 {
+		t.Errorf("Decode into map[testColor]int returned %v, %v", colors, err)
+	}
+}
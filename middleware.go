@@ -0,0 +1,84 @@
+package amf
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// Call is a remoting call received by a Gateway.
+type Call struct {
+	// Message is the RemotingMessage of the call. For AMF0 requests it is built
+	// from the target URI and the arguments.
+	Message FlexRemotingMessage
+
+	// Headers are the headers of the envelope the call came in.
+	Headers []Header
+
+	// Request is the HTTP request the call came in.
+	Request *http.Request
+}
+
+// Handler answers a call with its result or an error. *FaultError errors are
+// sent as they are.
+type Handler func(ctx context.Context, call *Call) (interface{}, error)
+
+// Middleware wraps a handler to act around calls: it can inspect the call,
+// reject it by returning an error without calling next, or change the result.
+type Middleware func(next Handler) Handler
+
+type callKey struct{}
+
+// CallFromContext returns the call being handled, for use by service methods
+// taking a context.
+func CallFromContext(ctx context.Context) (*Call, bool) {
+	call, ok := ctx.Value(callKey{}).(*Call)
+	return call, ok
+}
+
+// Use adds middleware around the calls of registered services. The first
+// middleware added is the outermost. Use must not be called while serving.
+func (gw *Gateway) Use(middleware ...Middleware) {
+	gw.middleware = append(gw.middleware, middleware...)
+}
+
+// Recover turns panics of the handlers it wraps into Server.Processing faults,
+// and logs them with their stack trace if logger is not nil.
+func Recover(logger *slog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, call *Call) (result interface{}, err error) {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					if logger != nil {
+						logger.ErrorContext(ctx, "panic in remoting call",
+							"destination", call.Message.Destination,
+							"operation", call.Message.Operation,
+							"panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+					}
+					result = nil
+					err = &FaultError{FaultCode: "Server.Processing",
+						FaultString: "Internal server error"}
+				}
+			}()
+			return next(ctx, call)
+		}
+	}
+}
+
+// dispatch calls the operation of a call through the middleware.
+func (gw *Gateway) dispatch(ctx context.Context, call *Call) (interface{}, error) {
+	handler := Handler(func(ctx context.Context, call *Call) (interface{}, error) {
+		if s, ok := gw.services[call.Message.Destination]; ok {
+			if err := gw.checkAccess(ctx, s, call); err != nil {
+				return nil, err
+			}
+		}
+		return gw.call(ctx, call.Message.Destination, call.Message.Operation, call.Message.Body)
+	})
+	for i := len(gw.middleware) - 1; i >= 0; i-- {
+		handler = gw.middleware[i](handler)
+	}
+	return handler(context.WithValue(ctx, callKey{}, call), call)
+}
@@ -0,0 +1,65 @@
+package amf
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func (s *testService) Crash() {
+	panic("crash")
+}
+
+func TestGatewayMiddleware(t *testing.T) {
+	gw := NewGateway()
+	gw.Register("Items", &testService{prefix: "item"})
+
+	var trace []string
+	tracer := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, call *Call) (interface{}, error) {
+				trace = append(trace, name+" "+call.Message.Operation)
+				return next(ctx, call)
+			}
+		}
+	}
+	gw.Use(Recover(nil), tracer("outer"), tracer("inner"))
+	gw.Use(func(next Handler) Handler {
+		return func(ctx context.Context, call *Call) (interface{}, error) {
+			if call.Message.Operation == "reset" {
+				return nil, &FaultError{FaultCode: "Client.Authorization", FaultString: "denied"}
+			}
+			if current, ok := CallFromContext(ctx); !ok || current != call {
+				t.Errorf("CallFromContext returned %v, %v", current, ok)
+			}
+			if call.Request == nil || call.Request.Method != "POST" {
+				t.Errorf("Wrong HTTP request: %v", call.Request)
+			}
+			return next(ctx, call)
+		}
+	})
+
+	server := httptest.NewServer(gw)
+	defer server.Close()
+	ctx := context.Background()
+	client := NewClient(server.URL)
+
+	var item testItem
+	if err := client.Call(ctx, "Items", "find", &item, 3); err != nil || item.Name != "item3" {
+		t.Errorf("find returned %+v, %v", item, err)
+	}
+	if len(trace) != 2 || trace[0] != "outer find" || trace[1] != "inner find" {
+		t.Errorf("Wrong middleware order: %v", trace)
+	}
+
+	var fault *FaultError
+	if err := client.Call(ctx, "Items", "reset", nil); !errors.As(err, &fault) ||
+		fault.FaultCode != "Client.Authorization" {
+		t.Errorf("Expected a Client.Authorization fault, got %v", err)
+	}
+	if err := client.Call(ctx, "Items", "crash", nil); !errors.As(err, &fault) ||
+		fault.FaultCode != "Server.Processing" || fault.FaultString != "Internal server error" {
+		t.Errorf("Expected a recovered panic, got %v", err)
+	}
+}
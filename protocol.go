@@ -1,15 +1,23 @@
 package amf
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"reflect"
-	"strings"
+	"sort"
+	"time"
 )
 
 // Reference bit.
 const REFERENCE_BIT = 0x01
+
+// Deprecated: ExtObj used to stand in for externalizable objects. They are now
+// replaced by the value they wrap.
 const ExtObj = "nilGoNullNilExtObj"
 
 type Reader interface {
@@ -24,6 +32,19 @@ type AvmObject struct {
 	Class         *AvmClass
 	StaticFields  map[string]interface{}
 	DynamicFields map[string]interface{}
+
+	// Order of the dynamic fields. Fields missing from DynamicKeys are written
+	// after the others, sorted by name.
+	DynamicKeys []string
+}
+
+// Get returns the value of a sealed or dynamic member.
+func (object AvmObject) Get(name string) (interface{}, bool) {
+	if value, ok := object.StaticFields[name]; ok {
+		return value, true
+	}
+	value, ok := object.DynamicFields[name]
+	return value, ok
 }
 
 type AvmClass struct {
@@ -36,8 +57,26 @@ type AvmClass struct {
 // An "Array" in AVM land is actually stored as a combination of an array and
 // a dictionary.
 type AvmArray struct {
-	elements []interface{}
-	fields   map[string]interface{}
+	// Dense part.
+	Elements []interface{}
+
+	// Associative part.
+	Fields map[string]interface{}
+
+	// Order of the associative part. Fields missing from Keys are written after
+	// the others, sorted by name.
+	Keys []string
+}
+
+// Set stores an associative field, keeping track of the order of the keys.
+func (array *AvmArray) Set(key string, value interface{}) {
+	if array.Fields == nil {
+		array.Fields = make(map[string]interface{})
+	}
+	if _, seen := array.Fields[key]; !seen {
+		array.Keys = append(array.Keys, key)
+	}
+	array.Fields[key] = value
 }
 
 // * Public functions *
@@ -52,11 +91,15 @@ func ReadValueAmf3(stream Reader) (interface{}, error) {
 }
 
 func WriteValueAmf3(stream Writer, value interface{}) error {
-	cxt := &Encoder{}
-	cxt.stream = stream
+	cxt := NewEncoder(stream)
 	return cxt.WriteValueAmf3(value)
 }
 
+var (
+	// Class definition shared by all maps.
+	anonymousClass = &AvmClass{Dynamic: true}
+)
+
 // Type markers
 const (
 	amf0_numberType        = 0
@@ -108,9 +151,23 @@ type Decoder struct {
 
 	decodeError error
 
+	// Open containers while streaming with Next.
+	frames []streamFrame
+
+	// Number of values being read, one inside the other.
+	depth int
+
 	// When unpacking objects, we'll look in this map for the type name. If found,
 	// we'll unpack the value into an instance of the associated type.
 	typeMap map[string]reflect.Type
+
+	// Set for envelopes: members of registered objects that can't be assigned
+	// are left out and logged, instead of failing the decoding.
+	skipMemberErrors bool
+
+	// Logger receives diagnostics, such as unsupported type markers. Nothing is
+	// logged if nil.
+	Logger *slog.Logger
 }
 
 func NewDecoder(stream Reader, amfVersion uint16) *Decoder {
@@ -129,11 +186,16 @@ func (cxt *Decoder) saveError(err error) {
 		return
 	}
 	if cxt.decodeError != nil {
-		fmt.Println("warning: duplicate errors on Decoder")
+		cxt.log(slog.LevelDebug, "ignoring decode error after the first one", "error", err)
 	} else {
 		cxt.decodeError = err
 	}
 }
+func (cxt *Decoder) log(level slog.Level, msg string, args ...interface{}) {
+	if cxt.Logger != nil {
+		cxt.Logger.Log(context.Background(), level, msg, args...)
+	}
+}
 func (cxt *Decoder) errored() bool {
 	return cxt.decodeError != nil
 }
@@ -147,7 +209,7 @@ func (cxt *Decoder) RegisterType(flexName string, instance interface{}) {
 // Helper functions.
 func (cxt *Decoder) ReadByte() uint8 {
 	buf := make([]byte, 1)
-	_, err := cxt.stream.Read(buf)
+	_, err := io.ReadFull(cxt.stream, buf)
 	cxt.saveError(err)
 	return buf[0]
 }
@@ -165,13 +227,51 @@ func (cxt *Decoder) ReadUint16() uint16 {
 }
 
 func (cxt *Decoder) Clear() {
+	cxt.resetStream()
+	cxt.typeMap = make(map[string]reflect.Type)
+	return
+}
+
+// MaxDepth is how deep values can be nested in decoded data. Deeper values fail
+// decoding, rather than the stack of the decoder.
+const MaxDepth = 1000
+
+// enter notes that a value is being read inside the current one, and reports
+// false, failing decoding, if that goes beyond MaxDepth.
+func (cxt *Decoder) enter() bool {
+	if cxt.depth >= MaxDepth {
+		cxt.saveError(errors.New(fmt.Sprintf("Values nested deeper than %d", MaxDepth)))
+		return false
+	}
+	cxt.depth++
+	return true
+}
+
+func (cxt *Decoder) leave() {
+	cxt.depth--
+}
+
+// checkCount fails decoding if count items, of one byte at least, don't fit in
+// the rest of the input, when its length is known, as it is for bytes.Buffer and
+// bytes.Reader inputs.
+func (cxt *Decoder) checkCount(count int) bool {
+	if input, ok := cxt.stream.(interface{ Len() int }); ok && count > input.Len() {
+		cxt.saveError(errors.New(fmt.Sprintf("Count of %d is beyond the end of the input", count)))
+		return false
+	}
+	return true
+}
+
+// resetStream resets the stream state (reference tables and errors), as is
+// needed at the start of every message body. Unlike Clear, it keeps the
+// registered types.
+func (cxt *Decoder) resetStream() {
 	cxt.IsAMF3 = false
 	cxt.stringTable = []string{}
 	cxt.classTable = []*AvmClass{}
 	cxt.objectTable = []interface{}{}
 	cxt.decodeError = nil
-	cxt.typeMap = make(map[string]reflect.Type)
-	return
+	cxt.frames = nil
 }
 
 func (cxt *Decoder) ReadUint32() uint32 {
@@ -197,25 +297,112 @@ func (cxt *Decoder) ReadString() (int, string) {
 	return length, cxt.ReadStringKnownLength(length)
 }
 
+// ReadStringKnownLength reads a string of length bytes. As the length comes from
+// the input, the string is read as it arrives rather than allocated up front.
 func (cxt *Decoder) ReadStringKnownLength(length int) string {
-	data := make([]byte, length)
-	n, err := cxt.stream.Read(data)
-	if n < length {
+	var data bytes.Buffer
+	data.Grow(min(length, maxPreallocation))
+	n, err := io.CopyN(&data, cxt.stream, int64(length))
+	if n < int64(length) {
 		cxt.saveError(errors.New(fmt.Sprintf(
 			"Not enough bytes in ReadStringKnownLength (expected %d, found %d)", length, n)))
 		return ""
 	}
 	cxt.saveError(err)
-	return string(data)
+	return data.String()
 }
 
+// maxPreallocation bounds what is allocated from lengths read off the input,
+// before the data is there.
+const maxPreallocation = 64 << 10
+
 type Encoder struct {
 	stream Writer
+
+	// AMF version used by WriteValue, 0 or 3.
+	AmfVersion uint16
+
+	// AMF3 reference tables for outgoing strings, classes and objects.
+	stringTable map[string]int
+	classTable  map[*AvmClass]int
+	objectTable map[interface{}]int
+	objectCount int
+
+	// Class definitions generated for struct types.
+	structClasses map[reflect.Type]*AvmClass
+
+	// Values being written in AMF0, which has no references to write cycles
+	// with.
+	amf0Open map[interface{}]bool
+
+	// Logger receives diagnostics, such as values truncated to fit. Nothing is
+	// logged if nil.
+	Logger *slog.Logger
 }
 
 func NewEncoder(stream Writer) *Encoder {
-	return &Encoder{stream}
+	return &Encoder{stream: stream, AmfVersion: 3}
+}
+
+func (cxt *Encoder) log(level slog.Level, msg string, args ...interface{}) {
+	if cxt.Logger != nil {
+		cxt.Logger.Log(context.Background(), level, msg, args...)
+	}
+}
+
+// Clear resets the reference tables, as is needed at the start of every message
+// body.
+func (cxt *Encoder) Clear() {
+	cxt.stringTable = nil
+	cxt.classTable = nil
+	cxt.objectTable = nil
+	cxt.objectCount = 0
+	cxt.structClasses = nil
+}
+
+// objectKey identifies a Go value that can be written once and referenced after.
+type objectKey struct {
+	pointer uintptr
+	typ     reflect.Type
+	length  int
+}
+
+// identityOf returns the identity of a pointer, map or non-empty slice, or nil
+// for values that have none.
+func identityOf(value reflect.Value) interface{} {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Map:
+		if value.IsNil() {
+			return nil
+		}
+		return objectKey{value.Pointer(), value.Type(), 0}
+	case reflect.Slice:
+		if value.Len() == 0 {
+			return nil
+		}
+		return objectKey{value.Pointer(), value.Type(), value.Len()}
+	}
+	return nil
+}
+
+// writeObjectReference writes a reference if the value with the given identity
+// was written before, and reports whether it did. Otherwise the value takes the
+// next slot in the object table, like every object, array and date written inline.
+func (cxt *Encoder) writeObjectReference(identity interface{}) bool {
+	if identity != nil {
+		if index, ok := cxt.objectTable[identity]; ok {
+			cxt.WriteUint29(uint32(index << 1))
+			return true
+		}
+		if cxt.objectTable == nil {
+			cxt.objectTable = make(map[interface{}]int)
+		}
+		cxt.objectTable[identity] = cxt.objectCount
+	}
+	cxt.objectCount++
+	return false
 }
+
 func (cxt *Encoder) WriteUint8(value uint8) error {
 	return binary.Write(cxt.stream, binary.BigEndian, &value)
 }
@@ -271,7 +458,8 @@ func (cxt *Encoder) WriteUint29(value uint32) error {
 	// Make sure the value is only 29 bits.
 	remainder := value & 0x1fffffff
 	if remainder != value {
-		fmt.Println("warning: WriteUint29 received a value that does not fit in 29 bits")
+		cxt.log(slog.LevelWarn, "WriteUint29 received a value that does not fit in 29 bits",
+			"value", value)
 	}
 
 	if remainder > 0x1fffff {
@@ -293,31 +481,38 @@ func (cxt *Encoder) WriteUint29(value uint32) error {
 	return nil
 }
 
-func (cxt *Decoder) readDateAmf3() uint32 {
+// Read an AMF3 integer: a signed 29-bit value.
+func (cxt *Decoder) readIntAmf3() int32 {
+	value := cxt.ReadUint29()
+	if value&0x10000000 != 0 {
+		return int32(value) - 1<<29
+	}
+	return int32(value)
+}
+
+// Read an AMF3 date: milliseconds since the epoch, in UTC.
+func (cxt *Decoder) readDateAmf3() interface{} {
 	ref := cxt.ReadUint29()
 
 	if cxt.errored() {
-		return 0
+		return nil
 	}
 
 	// Check the low bit to see if this is a reference
 	if (ref & REFERENCE_BIT) == 0 {
 		index := int(ref >> 1)
-		if index >= len(cxt.stringTable) {
-			cxt.saveError(errors.New(fmt.Sprintf("Invalid string index: %d", index)))
-			return 0
-		}
-
-		if v, ok := cxt.objectTable[index].(uint32); ok {
-			return v
+		if index >= len(cxt.objectTable) {
+			cxt.saveError(errors.New(fmt.Sprintf("Invalid object index: %d", index)))
+			return nil
 		}
-
-		return 0
+		return cxt.objectTable[index]
 	}
 
 	ms := cxt.ReadFloat64()
-	// TODO: timezone_offset
-	result := uint32(ms / 1000.0)
+	if cxt.errored() {
+		return nil
+	}
+	result := time.UnixMilli(int64(ms)).UTC()
 	cxt.storeObjectInTable(result)
 	return result
 }
@@ -358,13 +553,19 @@ func (cxt *Encoder) WriteStringAmf3(s string) error {
 		return cxt.writeByte(0x01)
 	}
 
-	// TODO: Support outgoing string references.
+	if index, ok := cxt.stringTable[s]; ok {
+		return cxt.WriteUint29(uint32(index << 1))
+	}
+	if cxt.stringTable == nil {
+		cxt.stringTable = make(map[string]int)
+	}
+	cxt.stringTable[s] = len(cxt.stringTable)
 
 	cxt.WriteUint29(uint32((length << 1) | 0x01))
 
-	cxt.stream.Write([]byte(s))
+	_, err := cxt.stream.Write([]byte(s))
 
-	return nil
+	return err
 }
 
 func (cxt *Decoder) readObjectAmf3() interface{} {
@@ -386,53 +587,49 @@ func (cxt *Decoder) readObjectAmf3() interface{} {
 	}
 
 	class := cxt.readClassDefinitionAmf3(ref)
+	if cxt.errored() {
+		return nil
+	}
 
-	object := AvmObject{}
-	object.Class = class
-
-	// For an anonymous class, just return a map[string] interface{}
-	if object.Class.Name == "" {
-		if object.StaticFields == nil {
-			object.StaticFields = make(map[string]interface{})
-		}
-		result := make(map[string]interface{})
-		for _, prop := range class.Properties {
-			value := cxt.ReadValueAmf3()
-			object.StaticFields[prop] = value
-		}
-		if class.Dynamic {
-			for {
-				name := cxt.readStringAmf3()
-				if name == "" {
-					break
-				}
-				value := cxt.ReadValueAmf3()
-				result[name] = value
-			}
+	// Registered externalizable types read their own data.
+	if goType, ok := cxt.typeMap[class.Name]; ok && class.Externalizable {
+		if result, ok := cxt.readUnmarshaler(goType); ok {
+			return result
 		}
-		return result
 	}
 
+	// Externalizable classes that aren't registered are assumed to wrap a single
+	// value, like flex.messaging.io.ArrayCollection, and are replaced by it.
+	if class.Externalizable {
+		index := len(cxt.objectTable)
+		cxt.storeObjectInTable(nil)
+		value := cxt.ReadValueAmf3()
+		cxt.objectTable[index] = value
+		return value
+	}
+
+	// Anonymous objects are returned as a map holding both sealed and dynamic
+	// members.
+	if class.Name == "" {
+		return cxt.readAnonymousObjectAmf3(class)
+	}
+
+	object := AvmObject{}
+	object.Class = class
+
+	object.StaticFields = make(map[string]interface{}, len(class.Properties))
 	object.DynamicFields = make(map[string]interface{})
 
-	// Store the object in the table before doing any decoding.
-	cxt.storeObjectInTable(&object)
+	// Store the object in the table before doing any decoding. The slot is
+	// updated once the object is complete.
+	index := len(cxt.objectTable)
+	cxt.storeObjectInTable(object)
 
 	// Read static fields
-	object.StaticFields = make(map[string]interface{}, len(class.Properties))
-	for i := 0; i < len(class.Properties); i++ {
-		v := class.Properties[i]
-		value := cxt.ReadValueAmf3()
-		if value == ExtObj {
-			i = i - 1
-			continue
-		}
-		object.StaticFields[v] = value
+	for _, v := range class.Properties {
+		object.StaticFields[v] = cxt.ReadValueAmf3()
 	}
 
-	//fmt.Printf("static fields = %v\n", object.StaticFields)
-	//fmt.Printf("static properties = %v\n", class.Properties)
-
 	if class.Dynamic {
 		// Parse dynamic fields
 		for {
@@ -442,51 +639,123 @@ func (cxt *Decoder) readObjectAmf3() interface{} {
 			}
 
 			value := cxt.ReadValueAmf3()
+			if _, seen := object.DynamicFields[name]; !seen {
+				object.DynamicKeys = append(object.DynamicKeys, name)
+			}
 			object.DynamicFields[name] = value
 		}
 	}
 
 	// If this type is registered, then unpack this result into an instance of the type.
-	// TODO: This could be faster if we didn't create an intermediate AvmObject.
-	goType, foundGoType := cxt.typeMap[class.Name]
-
-	if foundGoType {
-		result := reflect.Indirect(reflect.New(goType))
-		//for i, v := range class.Properties{
-		for i := 0; i < len(class.Properties); i++ {
-			v := class.Properties[i]
-			value := reflect.ValueOf(object.StaticFields[v])
-			fieldName := class.Properties[i]
-			// The Go type will have field names with capital letters
-			fieldName = strings.ToUpper(fieldName[:1]) + fieldName[1:]
-			field := result.FieldByName(fieldName)
-			fmt.Printf("Attempting to write %v to field %v\n", object.StaticFields[v],
-				class.Properties[i])
-			field.Set(value)
+	if result, ok := cxt.applyRegisteredType(object); ok {
+		cxt.objectTable[index] = result
+		return result
+	}
+
+	cxt.objectTable[index] = object
+	return object
+}
+
+func (cxt *Decoder) readAnonymousObjectAmf3(class *AvmClass) map[string]interface{} {
+	result := make(map[string]interface{}, len(class.Properties))
+
+	// Store the map before reading the members, which may refer back to it.
+	cxt.storeObjectInTable(result)
+
+	for _, prop := range class.Properties {
+		result[prop] = cxt.ReadValueAmf3()
+		if cxt.errored() {
+			return result
+		}
+	}
+
+	if class.Dynamic {
+		for {
+			name := cxt.readStringAmf3()
+			if name == "" || cxt.errored() {
+				break
+			}
+			result[name] = cxt.ReadValueAmf3()
+			if cxt.errored() {
+				break
+			}
 		}
-		return result.Interface()
+	}
+	return result
+}
+
+// applyRegisteredType converts a decoded object into an instance of the Go type
+// registered for its class. It reports false if the class isn't registered.
+func (cxt *Decoder) applyRegisteredType(object AvmObject) (interface{}, bool) {
+	// TODO: This could be faster if we didn't create an intermediate AvmObject.
+	goType, foundGoType := cxt.typeMap[object.Class.Name]
+	if !foundGoType {
+		return nil, false
 	}
 
-	if len(class.Properties) == 0 { // patch for resp body content
-		return ExtObj
+	// assignValue also hands the object to ValueUnmarshaler implementations.
+	result := reflect.New(goType).Elem()
+	assigner := &assigner{skipMemberErrors: cxt.skipMemberErrors}
+	if err := assigner.assign(result, object); err != nil {
+		cxt.saveError(errors.New(fmt.Sprintf("Cannot decode %s into %v: %v",
+			object.Class.Name, goType, err)))
 	}
-	return object
+	for _, err := range assigner.skipped {
+		cxt.log(slog.LevelWarn, "member left out of decoded object",
+			"class", object.Class.Name, "error", err)
+	}
+	return result.Interface(), true
 }
 
 func (cxt *Encoder) writeObjectAmf3(value interface{}) error {
 
-	fmt.Printf("writeObjectAmf3 attempting to write a value of type %s\n",
-		reflect.ValueOf(value).Type().Name())
+	cxt.log(slog.LevelDebug, "writeObjectAmf3 attempting to write a value",
+		"type", reflect.TypeOf(value))
 
 	return nil
 }
 
+// Write an AvmObject: sealed members in trait order, then dynamic members. For an
+// externalizable class only the class definition is written; the caller (usually
+// a Marshaler) writes the externalized data.
 func (cxt *Encoder) writeAvmObject3(value *AvmObject) error {
-	// TODO: Support outgoing object references.
+	// Copies of the same decoded object share their maps, so use those as the
+	// identity of the object.
+	identity := identityOf(reflect.ValueOf(value.StaticFields))
+	if identity == nil {
+		identity = identityOf(reflect.ValueOf(value.DynamicFields))
+	}
+	if cxt.writeObjectReference(identity) {
+		return nil
+	}
+
+	class := value.Class
+	if class == nil {
+		class = &AvmClass{Dynamic: true}
+	}
 
 	// writeClassDefinitionAmf3 will also write the ref section.
-	cxt.writeClassDefinitionAmf3(value.Class)
+	cxt.writeClassDefinitionAmf3(class)
+
+	if class.Externalizable {
+		return nil
+	}
 
+	for _, name := range class.Properties {
+		if err := cxt.WriteValueAmf3(value.StaticFields[name]); err != nil {
+			return err
+		}
+	}
+
+	if class.Dynamic {
+		for _, name := range orderedKeys(value.DynamicKeys, value.DynamicFields) {
+			cxt.WriteStringAmf3(name)
+			if err := cxt.WriteValueAmf3(value.DynamicFields[name]); err != nil {
+				return err
+			}
+		}
+		cxt.WriteStringAmf3("")
+	}
 	return nil
 }
 
@@ -495,83 +764,161 @@ func (cxt *Encoder) writeReflectedMapAmf3(value reflect.Value) error {
 		return errors.New("writeReflectedMapAmf3 called with non-struct value")
 	}
 
-	ref := 0x00
-	numFields := 0
-	ref += numFields << 4
-	final_ref := ref |
-		0x02<<2 |
-		REFERENCE_BIT<<1 |
-		REFERENCE_BIT
+	if cxt.writeObjectReference(identityOf(value)) {
+		return nil
+	}
 
-	cxt.WriteUint29(uint32(final_ref))
-	cxt.WriteUint8(0x01) //alias.anonymous
-	mk := value.MapKeys()
-	for _, k := range mk {
-		cxt.WriteStringAmf3(k.String())
+	// Maps are anonymous dynamic objects.
+	cxt.writeClassDefinitionAmf3(anonymousClass)
 
-		if val, ok := value.MapIndex(k).Interface().(string); ok {
+	entries, err := sortedMapEntries(value)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		cxt.WriteStringAmf3(entry.key)
+
+		if val, ok := entry.value.Interface().(string); ok {
 			if val == "" {
 				cxt.WriteUint8(amf3_nullType)
 				continue
 			}
 		}
-		cxt.WriteValueAmf3(value.MapIndex(k).Interface())
+		if err := cxt.WriteValueAmf3(entry.value.Interface()); err != nil {
+			return err
+		}
 	}
-	cxt.WriteUint8(0x01)
+	cxt.WriteStringAmf3("")
 	return nil
 }
 
-func (cxt *Encoder) writeReflectedStructAmf3(value reflect.Value) error {
+type mapEntry struct {
+	key   string
+	value reflect.Value
+}
 
-	if value.Kind() != reflect.Struct {
-		return errors.New("writeReflectedStructAmf3 called with non-struct value")
+// sortedMapEntries returns the members of a Go map sorted by name, so that the
+// same map always encodes to the same bytes.
+func sortedMapEntries(value reflect.Value) ([]mapEntry, error) {
+	entries := make([]mapEntry, 0, value.Len())
+	for _, k := range value.MapKeys() {
+		key, err := mapKeyString(k)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, mapEntry{key, value.MapIndex(k)})
 	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries, nil
+}
 
-	ref := 0x00
-	numFields := value.Type().NumField()
-	ref += numFields << 4
-	final_ref := ref |
-		0x02<<2 |
-		REFERENCE_BIT<<1 |
-		REFERENCE_BIT
+// orderedKeys returns the names of a set of fields: first those listed in keys,
+// in that order, then the others sorted.
+func orderedKeys(keys []string, fields map[string]interface{}) []string {
+	result := make([]string, 0, len(fields))
+	listed := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if _, ok := fields[k]; ok && !listed[k] {
+			listed[k] = true
+			result = append(result, k)
+		}
+	}
+	if len(result) == len(fields) {
+		return result
+	}
 
-	cxt.WriteUint29(uint32(final_ref))
+	rest := make(map[string]interface{}, len(fields)-len(result))
+	for k, v := range fields {
+		if !listed[k] {
+			rest[k] = v
+		}
+	}
+	return append(result, sortedKeys(rest)...)
+}
 
-	//cxt.WriteStringAmf3(value.Type().Name())
-	if value.Type().Name() == "FlexRemotingMessage" {
-		cxt.WriteStringAmf3("flex.messaging.messages.RemotingMessage")
+// sortedKeys returns the names of a set of fields in sorted order.
+func sortedKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
 	}
-	// Class name
-	//cxt.WriteStringAmf3(value.Type().Name())
-	//fmt.Printf("wrote class name = %s\n", value.Type().Name())
+	sort.Strings(keys)
+	return keys
+}
 
-	// Property names
-	for i := 0; i < numFields; i++ {
-		structField := value.Type().Field(i)
-		//xxname:=structField.Name
-		cxt.WriteStringAmf3(lowerFirst(structField.Name))
-		//fmt.Printf("wrote field name = %s\n", structField.Name)
+func (cxt *Encoder) writeReflectedStructAmf3(value reflect.Value, identity interface{}) error {
+
+	if value.Kind() != reflect.Struct {
+		return errors.New("writeReflectedStructAmf3 called with non-struct value")
 	}
 
+	if cxt.writeObjectReference(identity) {
+		return nil
+	}
+
+	info := structInfoOf(value.Type())
+	cxt.writeClassDefinitionAmf3(cxt.structClass(value.Type(), info))
+
 	// Property values
-	for i := 0; i < numFields; i++ {
-		if val, ok := value.Field(i).Interface().(string); ok {
+	for _, field := range info.fields {
+		fieldValue := value.Field(field.index)
+		if val, ok := fieldValue.Interface().(string); ok {
 			if val == "" {
 				cxt.WriteUint8(amf3_nullType)
 				continue
 			}
 		}
-		cxt.WriteValueAmf3(value.Field(i).Interface())
+		if err := cxt.WriteValueAmf3(fieldValue.Interface()); err != nil {
+			return err
+		}
 	}
 
-	cxt.WriteUint8(0x01)
+	// The extra field holds the dynamic members.
+	extra, err := info.extraFields(value)
+	if err != nil {
+		return err
+	}
+	for _, entry := range extra {
+		cxt.WriteStringAmf3(entry.key)
+		if err := cxt.WriteValueAmf3(entry.value.Interface()); err != nil {
+			return err
+		}
+	}
+	cxt.WriteStringAmf3("")
 	return nil
 }
 
+// structClass returns the class definition used for a struct type. The same
+// *AvmClass is returned for every value of the type, so that the definition is
+// written only once per message.
+func (cxt *Encoder) structClass(structType reflect.Type, info *structInfo) *AvmClass {
+	if class, ok := cxt.structClasses[structType]; ok {
+		return class
+	}
+
+	class := &AvmClass{Name: flexClassNames[structType], Dynamic: true}
+	for _, field := range info.fields {
+		class.Properties = append(class.Properties, field.name)
+	}
+
+	if cxt.structClasses == nil {
+		cxt.structClasses = make(map[reflect.Type]*AvmClass)
+	}
+	cxt.structClasses[structType] = class
+	return class
+}
+
 func (cxt *Decoder) readClassDefinitionAmf3(ref uint32) *AvmClass {
 	// Check for a reference to an existing class definition
 	if (ref & 2) == 0 {
-		return cxt.classTable[int(ref>>2)]
+		index := int(ref >> 2)
+		if index >= len(cxt.classTable) {
+			cxt.saveError(errors.New(fmt.Sprintf("Invalid class index: %d", index)))
+			return &AvmClass{}
+		}
+		return cxt.classTable[index]
 	}
 
 	// Parse a class definition
@@ -581,11 +928,15 @@ func (cxt *Decoder) readClassDefinitionAmf3(ref uint32) *AvmClass {
 	dynamic := ref&8 != 0
 	propertyCount := ref >> 4
 
-	class := AvmClass{className, externalizable, dynamic, make([]string, propertyCount)}
+	if !cxt.checkCount(int(propertyCount)) {
+		return &AvmClass{}
+	}
+	properties := make([]string, 0, min(int(propertyCount), maxPreallocation))
+	class := AvmClass{className, externalizable, dynamic, properties}
 
 	// Property names
-	for i := uint32(0); i < propertyCount; i++ {
-		class.Properties[i] = cxt.readStringAmf3()
+	for i := uint32(0); i < propertyCount && !cxt.errored(); i++ {
+		class.Properties = append(class.Properties, cxt.readStringAmf3())
 	}
 
 	// Save the new class in the loopup table
@@ -595,8 +946,18 @@ func (cxt *Decoder) readClassDefinitionAmf3(ref uint32) *AvmClass {
 }
 
 func (cxt *Encoder) writeClassDefinitionAmf3(class *AvmClass) {
-	// TODO: Support class references
-	ref := uint32(0x2)
+	// Classes are identified by their *AvmClass, which decoded objects of the same
+	// class share.
+	if index, ok := cxt.classTable[class]; ok {
+		cxt.WriteUint29(uint32(index<<2) | REFERENCE_BIT)
+		return
+	}
+	if cxt.classTable == nil {
+		cxt.classTable = make(map[*AvmClass]int)
+	}
+	cxt.classTable[class] = len(cxt.classTable)
+
+	ref := uint32(0x2) | REFERENCE_BIT
 
 	if class.Externalizable {
 		ref += 0x4
@@ -640,85 +1001,102 @@ func (cxt *Decoder) readArrayAmf3() interface{} {
 	// Read name-value pairs, if any.
 	key := cxt.readStringAmf3()
 
+	if !cxt.checkCount(elementCount) {
+		return nil
+	}
+
 	// No name-value pairs, return a flat Go array.
 	if key == "" {
-		result := make([]interface{}, elementCount)
+		index := len(cxt.objectTable)
+		result := make([]interface{}, min(elementCount, maxPreallocation))
 		cxt.storeObjectInTable(result)
-		for i := 0; i < elementCount; i++ {
-			result[i] = cxt.ReadValueAmf3()
-		}
+		result = cxt.readElementsAmf3(result, elementCount)
+		cxt.objectTable[index] = result
 		return result
 	}
 
 	result := &AvmArray{}
-	result.fields = make(map[string]interface{})
+	result.Fields = make(map[string]interface{})
 
 	// Store the object in the table before doing any decoding.
 	cxt.storeObjectInTable(result)
 
 	for key != "" {
-		result.fields[key] = cxt.ReadValueAmf3()
+		result.Set(key, cxt.ReadValueAmf3())
 		key = cxt.readStringAmf3()
 	}
 
 	// Read dense elements
-	result.elements = make([]interface{}, elementCount)
-	for i := 0; i < elementCount; i++ {
-		result.elements[i] = cxt.ReadValueAmf3()
-	}
+	result.Elements = cxt.readElementsAmf3(
+		make([]interface{}, min(elementCount, maxPreallocation)), elementCount)
 
 	return result
 }
 
-func (cxt *Encoder) writeReflectedArrayAmf3(value reflect.Value) error {
+// readElementsAmf3 reads the count elements of an array into elements, which
+// is grown as they are read past its length. Arrays are allocated up to
+// maxPreallocation elements up front, so a reference to a larger array met
+// among its own elements sees only that many.
+func (cxt *Decoder) readElementsAmf3(elements []interface{}, count int) []interface{} {
+	for i := 0; i < count && !cxt.errored(); i++ {
+		value := cxt.ReadValueAmf3()
+		if i < len(elements) {
+			elements[i] = value
+		} else {
+			elements = append(elements, value)
+		}
+	}
+	return elements
+}
+
+func (cxt *Encoder) writeReflectedArrayAmf3(value reflect.Value, identity interface{}) error {
+
+	if identity == nil && value.Kind() == reflect.Slice {
+		identity = identityOf(value)
+	}
+	if cxt.writeObjectReference(identity) {
+		return nil
+	}
 
 	elementCount := value.Len()
 
-	// TODO: Support outgoing array references
 	ref := (elementCount << 1) + 1
 
 	cxt.WriteUint29(uint32(ref))
 
 	// Write an empty key since this is just a flat array.
-	//cxt.WriteStringAmf3("")
-	cxt.WriteUint8(0x01)
+	cxt.WriteStringAmf3("")
 
 	for i := 0; i < elementCount; i++ {
-		cxt.WriteValueAmf3(value.Index(i).Interface())
+		if err := cxt.WriteValueAmf3(value.Index(i).Interface()); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func (cxt *Encoder) writeFlatArrayAmf3(value []interface{}) error {
-	elementCount := len(value)
-
-	// TODO: Support outgoing array references
-	ref := (elementCount << 1) + 1
-
-	cxt.WriteUint29(uint32(ref))
-
-	// Write an empty key since this is just a flat array.
-	cxt.WriteStringAmf3("")
+	return cxt.writeReflectedArrayAmf3(reflect.ValueOf(value), nil)
+}
 
-	// Write dense elements
-	for i := 0; i < elementCount; i++ {
-		cxt.WriteValueAmf3(value[i])
+func (cxt *Encoder) writeMixedArray3(value *AvmArray, identity interface{}) error {
+	if cxt.writeObjectReference(identity) {
+		return nil
 	}
-	return nil
-}
 
-func (cxt *Encoder) writeMixedArray3(value *AvmArray) error {
-	elementCount := len(value.elements)
+	elementCount := len(value.Elements)
 
-	// TODO: Support outgoing array references
 	ref := (elementCount << 1) + 1
 
 	cxt.WriteUint29(uint32(ref))
 
-	// Write fields
-	for k, v := range value.fields {
+	// Write fields in their original order, then any others sorted so that the
+	// output is deterministic.
+	for _, k := range orderedKeys(value.Keys, value.Fields) {
 		cxt.WriteStringAmf3(k)
-		cxt.WriteValueAmf3(v)
+		if err := cxt.WriteValueAmf3(value.Fields[k]); err != nil {
+			return err
+		}
 	}
 
 	// Write a null name to indicate the end of fields.
@@ -726,7 +1104,9 @@ func (cxt *Encoder) writeMixedArray3(value *AvmArray) error {
 
 	// Write dense elements
 	for i := 0; i < elementCount; i++ {
-		cxt.WriteValueAmf3(value.elements[i])
+		if err := cxt.WriteValueAmf3(value.Elements[i]); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -744,9 +1124,10 @@ func (cxt *Decoder) readValueAmf0() interface{} {
 
 	typeMarker := cxt.ReadByte()
 
-	if cxt.errored() {
+	if cxt.errored() || !cxt.enter() {
 		return nil
 	}
+	defer cxt.leave()
 
 	// Most AMF0 types are not yet supported.
 
@@ -761,42 +1142,48 @@ func (cxt *Decoder) readValueAmf0() interface{} {
 		_, v := cxt.ReadString()
 		return v
 	case amf0_objectType:
-		result := map[string]interface{}{}
-		for true {
-			c1 := cxt.ReadByte()
-			c2 := cxt.ReadByte()
-			length := int(c1)<<8 + int(c2)
-			name := cxt.ReadStringKnownLength(length)
-			result[name] = cxt.readValueAmf0()
-		}
+		_, result := cxt.readObjectPropertiesAmf0()
 		return result
 
-	case amf0_movieClipType:
-		fmt.Printf("Movie clip type not supported")
 	case amf0_nullType:
 		return nil
 	case amf0_undefinedType:
 		return nil
-	case amf0_referenceType:
 	case amf0_ecmaArrayType:
 		return cxt.readArrayAmf0()
 	case amf0_objectEndType:
 		return "objectEnd"
 	case amf0_strictArrayType:
+		return cxt.readStrictArrayAmf0()
 	case amf0_dateType:
-	case amf0_longStringType:
+		return cxt.readDateAmf0()
+	case amf0_longStringType, amf0_xmlObjectType:
+		return cxt.ReadStringKnownLength(int(cxt.ReadUint32()))
 	case amf0_unsupporedType:
-	case amf0_recordsetType:
-	case amf0_xmlObjectType:
+		return nil
 	case amf0_typedObjectType:
+		return cxt.readTypedObjectAmf0()
 	case amf0_avmPlusObjectType:
 		return cxt.ReadValueAmf3()
 	}
 
-	fmt.Printf("AMF0 type marker was not supported: %d", typeMarker)
+	// Movie clips, references and record sets are not supported. Their data
+	// can't be skipped, so decoding stops here.
+	cxt.saveError(errors.New(fmt.Sprintf("AMF0 type marker not supported: %d", typeMarker)))
 	return nil
 }
 
+// Read an AMF0 date: milliseconds since the epoch, and a time zone which is
+// ignored, as it is by readers.
+func (cxt *Decoder) readDateAmf0() interface{} {
+	ms := cxt.ReadFloat64()
+	cxt.ReadUint16()
+	if cxt.errored() {
+		return nil
+	}
+	return time.UnixMilli(int64(ms)).UTC()
+}
+
 func (cxt *Decoder) ReadValueAmf3() interface{} {
 	// Read type marker
 	typeMarker := cxt.ReadByte()
@@ -816,6 +1203,15 @@ func (cxt *Decoder) ReadValueAmf3() interface{} {
 		}
 	}
 
+	return cxt.readValueAmf3WithMarker(typeMarker)
+}
+
+func (cxt *Decoder) readValueAmf3WithMarker(typeMarker uint8) interface{} {
+	if !cxt.enter() {
+		return nil
+	}
+	defer cxt.leave()
+
 	switch typeMarker {
 	case amf3_nullType, amf3_undefinedType:
 		return nil
@@ -824,7 +1220,7 @@ func (cxt *Decoder) ReadValueAmf3() interface{} {
 	case amf3_trueType:
 		return true
 	case amf3_integerType:
-		return cxt.ReadUint29()
+		return cxt.readIntAmf3()
 	case amf3_doubleType:
 		return cxt.ReadFloat64()
 	case amf3_stringType:
@@ -853,25 +1249,57 @@ func (cxt *Encoder) WriteValueAmf3(value interface{}) error {
 		return cxt.writeByte(amf3_nullType)
 	}
 
+	if raw, ok := rawValueOf(value); ok {
+		return cxt.WriteRawValue(raw)
+	}
+
 	return cxt.writeReflectedValueAmf3(reflect.ValueOf(value))
 }
 
 func (cxt *Encoder) writeReflectedValueAmf3(value reflect.Value) error {
+	// Pointers are written as the value they point to. The outermost pointer
+	// identifies the value for outgoing object references.
+	var identity interface{}
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return cxt.writeByte(amf3_nullType)
+		}
+		if identity == nil && value.Kind() == reflect.Ptr {
+			identity = identityOf(value)
+		}
+		value = value.Elem()
+	}
+
+	if handled, err := cxt.writeMarshaler(value, 3); handled {
+		return err
+	}
+
+	switch v := interfaceOf(value).(type) {
+	case AvmArray:
+		cxt.writeByte(amf3_arrayType)
+		return cxt.writeMixedArray3(&v, identity)
+	case AvmObject:
+		cxt.writeByte(amf3_objectType)
+		return cxt.writeAvmObject3(&v)
+	}
+
 	switch value.Kind() {
 	case reflect.String:
 		cxt.writeByte(amf3_stringType)
-		str, _ := value.Interface().(string)
-		return cxt.WriteStringAmf3(str)
+		return cxt.WriteStringAmf3(value.String())
 	case reflect.Bool:
 		if value.Bool() == false {
 			return cxt.writeByte(amf3_falseType)
 		} else {
 			return cxt.writeByte(amf3_trueType)
 		}
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
-		cxt.writeByte(amf3_integerType)
-		return cxt.WriteUint29(uint32(value.Int()))
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cxt.writeIntAmf3(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if value.Uint() >= 1<<28 {
+			cxt.writeByte(amf3_doubleType)
+			return cxt.WriteFloat64(float64(value.Uint()))
+		}
 		cxt.writeByte(amf3_integerType)
 		return cxt.WriteUint29(uint32(value.Uint()))
 	case reflect.Float32, reflect.Float64:
@@ -879,10 +1307,10 @@ func (cxt *Encoder) writeReflectedValueAmf3(value reflect.Value) error {
 		return cxt.WriteFloat64(value.Float())
 	case reflect.Array, reflect.Slice:
 		cxt.writeByte(amf3_arrayType)
-		return cxt.writeReflectedArrayAmf3(value)
+		return cxt.writeReflectedArrayAmf3(value, identity)
 	case reflect.Struct:
 		cxt.writeByte(amf3_objectType)
-		return cxt.writeReflectedStructAmf3(value)
+		return cxt.writeReflectedStructAmf3(value, identity)
 	case reflect.Map:
 		cxt.writeByte(amf3_objectType)
 		return cxt.writeReflectedMapAmf3(value)
@@ -892,6 +1320,16 @@ func (cxt *Encoder) writeReflectedValueAmf3(value reflect.Value) error {
 		value.Kind().String()))
 }
 
+// AMF3 integers are signed 29-bit values; anything larger is written as a double.
+func (cxt *Encoder) writeIntAmf3(value int64) error {
+	if value < -1<<28 || value >= 1<<28 {
+		cxt.writeByte(amf3_doubleType)
+		return cxt.WriteFloat64(float64(value))
+	}
+	cxt.writeByte(amf3_integerType)
+	return cxt.WriteUint29(uint32(value) & 0x1fffffff)
+}
+
 func lowerFirst(s string) string {
 	a := []byte(s)
 	a[0] += 32
@@ -899,6 +1337,25 @@ func lowerFirst(s string) string {
 	return s
 }
 
+// Read an AMF0 strict array. AMF0 references are not supported, so the array is
+// not stored in the object table (which holds AMF3 objects).
+func (cxt *Decoder) readStrictArrayAmf0() interface{} {
+	elementCount := int(cxt.ReadUint32())
+	if cxt.errored() {
+		return nil
+	}
+
+	result := make([]interface{}, 0)
+	for i := 0; i < elementCount; i++ {
+		value := cxt.ReadValue()
+		if cxt.errored() {
+			return nil
+		}
+		result = append(result, value)
+	}
+	return result
+}
+
 // ObjectProperty amf 对象属性
 type ObjectProperty struct {
 	Name  string
@@ -909,100 +1366,14 @@ type ObjectProperty struct {
 type EcmaArray []ObjectProperty
 
 func (cxt *Decoder) readArrayAmf0() interface{} {
-
-	ref := cxt.ReadUint32()
+	// The associative count is only a hint; the pairs end with an object end marker.
+	cxt.ReadUint32()
 	if cxt.errored() {
 		return nil
 	}
-	if int(ref) == 0 {
-		return nil
-	}
-	// elementCount := int(ref)
-	// result := make(EcmaArray, 0, elementCount)
-
-	// for {
-	// 	var elem ObjectProperty
-	// 	if len, elem.Name := cxt.ReadString(); len == 0 {
-	// 		return
-	// 	}
-	// 	if elem.Value := cxt.readValueAmf0(); elem.Value == nil {
-	// 		return
-	// 	}
-	// 	if elem.Value == amf0_objectEndType && len(elem.Name) == 0 {
-	// 		break
-	// 	}
-	// 	result = appned(result, elem)
-
-	// }
-
-	// return
-
-	// if (ref & 1) == 0 {
-	// 	index := int(ref >> 1)
-	// 	if index >= len(cxt.objectTable) {
-	// 		cxt.saveError(errors.New(fmt.Sprintf("Invalid array reference: %d", index)))
-	// 		return nil
-	// 	}
-	// }
-
-	// elementCount := int(ref)
-	// result := make([]interface{}, elementCount)
-	// cxt.storeObjectInTable(result)
-
-	// for i := 0; i < elementCount; i++ {
-	// 	cxt.
-	// 	result[i] = cxt.readValueAmf0()
-	// }
-	// return result
-
-	// for i := 0; i < elementCount; i++ {
-	// _, key := cxt.ReadString()
-	// // result[i] = cxt.readValueAmf0()
-	// // }
-	// if key == "" {
-	// 	result := make([]interface{}, elementCount)
-	// 	cxt.storeObjectInTable(result)
-	// 	for i := 0; i < elementCount; i++ {
-	// 		result[i] = cxt.readValueAmf0()
-	// 	}
-	// 	return result
-	// }
-
-	// result := &AvmArray{}
-	result := make(map[string]interface{})
-	_, key := cxt.ReadString()
-	// Store the object in the table before doing any decoding.
-	cxt.storeObjectInTable(result)
-
-	for key != "" {
-		result[key] = cxt.readValueAmf0()
-		_, key = cxt.ReadString()
-	}
-	if key == "" && cxt.readValueAmf0() == "objectEnd" {
-		return result
-	}
-	// result.elements = make([]interface{}, elementCount)
-	// for i := 0; i < elementCount; i++ {
-	// 	result.elements[i] = cxt.readValueAmf0()
-	// }
-	// return nil
 
+	_, result := cxt.readObjectPropertiesAmf0()
 	return result
-
-	// 	return cxt.objectTable[index]
-	// }
-	// elementCount := int(ref >> 1)
-
-	// associativeCount := binary.BigEndian.Uint32(decoder.u32[:])
-	// obj, err := decoder.readObject(r)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// if uint32(len(obj)) != associativeCount {
-	// 	return nil, errors.New("ECMAArray Count error")
-	// }
-	// decoder.refObjects = append(decoder.refObjects, obj)
-	// return obj, nil
 }
 
 // func storeObjectAmf0(obj interface{}){
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -76,7 +77,9 @@ func TestIntegers(t *testing.T) {
 	testReadAmf3(t, "047f", "127")
 	testReadAmf3(t, "048952", "1234")
 	testReadAmf3(t, "04ff7f", "16383")
-	testReadAmf3(t, "04ffffffff", "536870911")
+	testReadAmf3(t, "04ffffffff", "-1") // <- integers are signed
+	testReadAmf3(t, "04c0808000", "-268435456")
+	testReadAmf3(t, "04bfffffff", "268435455")
 	testReadAmf3(t, "049db7cd15", "123456789")
 
 	expectReadErrorAmf3(t, "04")
@@ -89,6 +92,13 @@ func TestIntegers(t *testing.T) {
 	testWriteAmf3(t, 127, "047f")
 	testWriteAmf3(t, 1234, "048952")
 	testWriteAmf3(t, 123456789, "049db7cd15")
+	testWriteAmf3(t, -1, "04ffffffff")
+	testWriteAmf3(t, int32(-268435456), "04c0808000")
+	testWriteAmf3(t, uint32(268435455), "04bfffffff")
+
+	// Readers sign-extend 29-bit integers, so larger values are doubles.
+	testWriteAmf3(t, 268435456, "0541b0000000000000")
+	testWriteAmf3(t, uint32(300000000), "0541b1e1a300000000")
 }
 
 func TestDoubles(t *testing.T) {
@@ -130,6 +140,18 @@ func TestObjects(t *testing.T) {
 	// Invalid object reference
 	expectReadErrorAmf3(t, "0a02")
 
+	// Anonymous object with sealed member "a" and dynamic member "b", then a
+	// reference to it.
+	testReadAmf3(t, "0905010a1b010361040103620402010a02", "[map[a:1 b:2] map[a:1 b:2]]")
+
+	// Anonymous object whose sealed member refers to itself.
+	blob, _ := hex.DecodeString("0a130103780a00")
+	value, err := ReadValueAmf3(bytes.NewBuffer(blob))
+	object, _ := value.(map[string]interface{})
+	if self, _ := object["x"].(map[string]interface{}); err != nil || self == nil ||
+		reflect.ValueOf(self).Pointer() != reflect.ValueOf(object).Pointer() {
+		t.Errorf("Self reference wasn't resolved to the same map (%v)", err)
+	}
 }
 
 func TestArrays(t *testing.T) {
@@ -140,7 +162,7 @@ func TestArrays(t *testing.T) {
 
 	// Mixed array
 	testReadAmf3(t, "09070361060b6170706c650362060d62616e616e6101040104020403",
-		"&{[1 2 3] map[a:apple b:banana]}")
+		"&{[1 2 3] map[a:apple b:banana] [a b]}")
 
 	expectReadErrorAmf3(t, "09")
 	expectReadErrorAmf3(t, "0900")
@@ -156,3 +178,64 @@ func TestArrays(t *testing.T) {
 func TestOther(t *testing.T) {
 	expectReadErrorAmf3(t, "ff")
 }
+
+func TestDeterministicMaps(t *testing.T) {
+	value := map[string]interface{}{"c": 3, "a": 1, "b": 2, "d": map[int]bool{2: true, 1: false}}
+	expected := "0a0b0103610401036204020363040303640a01033102033203" +
+		"0101"
+
+	// Map iteration order is random, so try a few times.
+	for i := 0; i < 20; i++ {
+		testWriteAmf3(t, value, expected)
+	}
+
+	mixed := &AvmArray{
+		Elements: []interface{}{1},
+		Fields:   map[string]interface{}{"y": 2, "x": 1, "z": 3},
+	}
+	for i := 0; i < 20; i++ {
+		testWriteAmf3(t, mixed, "09030378040103790402037a0403010401")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Objects of class "Foo" with sealed member "a" and dynamic members: the
+	// second uses a trait reference and string references, the third is a
+	// reference to the first.
+	blob := "0907010a1b07466f6f036104010362060378010a010402040606010a02"
+	expectedBytes, _ := hex.DecodeString(blob)
+	value := NewDecoder(bytes.NewBuffer(expectedBytes), 3).ReadValueAmf3()
+
+	array, _ := value.([]interface{})
+	if len(array) != 3 {
+		t.Fatalf("Expected an array of 3, got %v", value)
+	}
+	object, _ := array[1].(AvmObject)
+	if a, _ := object.Get("a"); a != int32(2) {
+		t.Errorf("Wrong sealed member: %v", a)
+	}
+	if b, _ := object.Get("b"); b != "x" {
+		t.Errorf("Wrong dynamic member: %v", b)
+	}
+
+	testWriteAmf3(t, value, blob)
+
+	mixed := NewDecoder(bytes.NewBuffer([]byte{0x09, 0x01, 0x03, 0x7a, 0x04, 0x01,
+		0x03, 0x61, 0x04, 0x02, 0x01}), 3).ReadValueAmf3()
+	testWriteAmf3(t, mixed, "0901037a04010361040201")
+}
+
+func TestDecoderClear(t *testing.T) {
+	cxt := NewDecoder(bytes.NewBuffer(nil), 3)
+	cxt.RegisterType("User", testUser{})
+	cxt.stringTable = append(cxt.stringTable, "name")
+
+	cxt.resetStream()
+	if len(cxt.stringTable) != 0 || cxt.typeMap["User"] == nil {
+		t.Errorf("resetStream should clear the tables and keep registered types")
+	}
+	cxt.Clear()
+	if len(cxt.typeMap) != 0 {
+		t.Errorf("Clear should forget registered types, got %v", cxt.typeMap)
+	}
+}
@@ -0,0 +1,114 @@
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+)
+
+// RawValue holds the encoded bytes of a value whose decoding has been deferred,
+// much like json.RawMessage. The decoder fills it with the exact bytes of the
+// value, including its type marker, and the encoder writes those bytes back
+// verbatim.
+//
+// References inside an AMF3 value may point at strings, classes and objects that
+// appeared earlier in the stream, so a RawValue also keeps a snapshot of the
+// reference tables it was read with. Decode uses the snapshot; the encoder does
+// not, so splicing a RawValue into a new stream is only safe where the reference
+// tables start out in the same state, as they do at the start of a message body.
+type RawValue struct {
+	Bytes []byte
+
+	amf3        bool
+	stringTable []string
+	classTable  []*AvmClass
+	objectTable []interface{}
+	typeMap     map[string]reflect.Type
+}
+
+// recordingReader copies everything read through it into buf.
+type recordingReader struct {
+	stream Reader
+	buf    bytes.Buffer
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.stream.Read(p)
+	r.buf.Write(p[:n])
+	return n, err
+}
+
+// ReadRawValue reads the next value (as ReadValue would) without keeping the
+// decoded result. The reference tables are still updated so that the rest of the
+// stream decodes correctly.
+func (cxt *Decoder) ReadRawValue() RawValue {
+	return cxt.readRawValue(cxt.IsAMF3, cxt.ReadValue)
+}
+
+// ReadRawValueAmf3 is like ReadRawValue for a value known to be AMF3-encoded.
+func (cxt *Decoder) ReadRawValueAmf3() RawValue {
+	return cxt.readRawValue(true, cxt.ReadValueAmf3)
+}
+
+func (cxt *Decoder) readRawValue(amf3 bool, read func() interface{}) RawValue {
+	// The tables only ever grow, so capping the capacity is enough to snapshot them.
+	raw := RawValue{
+		amf3:        amf3,
+		stringTable: cxt.stringTable[:len(cxt.stringTable):len(cxt.stringTable)],
+		classTable:  cxt.classTable[:len(cxt.classTable):len(cxt.classTable)],
+		objectTable: cxt.objectTable[:len(cxt.objectTable):len(cxt.objectTable)],
+		typeMap:     cxt.typeMap,
+	}
+
+	recorder := &recordingReader{stream: cxt.stream}
+	cxt.stream = recorder
+	read()
+	cxt.stream = recorder.stream
+
+	raw.Bytes = recorder.buf.Bytes()
+	return raw
+}
+
+// Decode decodes the deferred value, resolving references against the tables
+// that were in effect when it was read.
+func (raw RawValue) Decode() (interface{}, error) {
+	if len(raw.Bytes) == 0 {
+		return nil, errors.New("RawValue is empty")
+	}
+
+	cxt := NewDecoder(bytes.NewReader(raw.Bytes), 3)
+	cxt.IsAMF3 = raw.amf3
+	cxt.stringTable = append([]string{}, raw.stringTable...)
+	cxt.classTable = append([]*AvmClass{}, raw.classTable...)
+	cxt.objectTable = append([]interface{}{}, raw.objectTable...)
+	for name, goType := range raw.typeMap {
+		cxt.typeMap[name] = goType
+	}
+
+	var result interface{}
+	if raw.amf3 {
+		result = cxt.ReadValueAmf3()
+	} else {
+		result = cxt.ReadValue()
+	}
+	return result, cxt.decodeError
+}
+
+// WriteRawValue writes the bytes of a RawValue verbatim.
+func (cxt *Encoder) WriteRawValue(raw RawValue) error {
+	_, err := cxt.stream.Write(raw.Bytes)
+	return err
+}
+
+// rawValueOf reports whether value is a RawValue, or a pointer to one.
+func rawValueOf(value interface{}) (RawValue, bool) {
+	switch raw := value.(type) {
+	case RawValue:
+		return raw, true
+	case *RawValue:
+		if raw != nil {
+			return *raw, true
+		}
+	}
+	return RawValue{}, false
+}
@@ -1,8 +1,11 @@
 package amf
 
 import (
+	"bytes"
 	"errors"
 	"io"
+	"log/slog"
+	"reflect"
 	"strings"
 )
 
@@ -30,9 +33,9 @@ type FlexRemotingMessage struct {
 	Source    string
 }
 
-type FlexErrorMessage struct {
+type FlexCommandMessage struct {
 	// AbstractMessage:
-	Body        []interface{}
+	Body        interface{}
 	ClientId    string
 	Destination string
 	Headers     map[string]interface{}
@@ -40,15 +43,73 @@ type FlexErrorMessage struct {
 	Timestamp   uint32
 	TimeToLive  uint32
 
-	// AcknowledgeMessage:
-	Flags byte
+	// AsyncMessage:
+	CorrelationId string
+
+	// CommandMessage:
+	Operation uint32
+}
+
+// CommandMessage operations.
+const (
+	CLIENT_PING_OPERATION = 5
+	LOGIN_OPERATION       = 8
+	LOGOUT_OPERATION      = 9
+)
+
+// Class names of the Flex messages.
+const (
+	remotingMessageClass    = "flex.messaging.messages.RemotingMessage"
+	commandMessageClass     = "flex.messaging.messages.CommandMessage"
+	acknowledgeMessageClass = "flex.messaging.messages.AcknowledgeMessage"
+	errorMessageClass       = "flex.messaging.messages.ErrorMessage"
+)
+
+// Class names under which the message types are encoded.
+var flexClassNames = map[reflect.Type]string{
+	reflect.TypeOf(FlexRemotingMessage{}):    remotingMessageClass,
+	reflect.TypeOf(FlexCommandMessage{}):     commandMessageClass,
+	reflect.TypeOf(FlexAcknowledgeMessage{}): acknowledgeMessageClass,
+	reflect.TypeOf(FlexErrorMessage{}):       errorMessageClass,
+}
+
+type FlexAcknowledgeMessage struct {
+	// AbstractMessage:
+	Body        interface{}
+	ClientId    string
+	Destination string
+	Headers     map[string]interface{}
+	MessageId   string
+
+	// Milliseconds since the epoch, and milliseconds, sent as doubles.
+	Timestamp  float64
+	TimeToLive float64
+
+	// AsyncMessage:
+	CorrelationId string
+}
+
+type FlexErrorMessage struct {
+	// AbstractMessage:
+	Body        interface{}
+	ClientId    string
+	Destination string
+	Headers     map[string]interface{}
+	MessageId   string
+
+	// Milliseconds since the epoch, and milliseconds, sent as doubles.
+	Timestamp  float64
+	TimeToLive float64
+
+	// AsyncMessage:
+	CorrelationId string
 
 	// ErrorMessage:
-	ExtendedData string
-	FaultCode    int
-	FaultDetail  int
+	ExtendedData map[string]interface{}
+	FaultCode    string
+	FaultDetail  string
 	FaultString  string
-	RootCause    string
+	RootCause    interface{}
 }
 
 type MessageBundle struct {
@@ -69,9 +130,28 @@ type AmfMessage struct {
 }
 
 func DecodeMessageBundle(stream io.Reader) (*MessageBundle, error) {
+	return decodeMessageBundle(stream, false, nil)
+}
+
+// DecodeMessageBundleRaw is like DecodeMessageBundle, but leaves header values
+// and message bodies undecoded: each Header.Value and AmfMessage.Body is a
+// RawValue. Call Decode on the parts that need inspecting; passing the bundle to
+// EncodeMessageBundle writes the raw parts back untouched, which is what a proxy
+// needs.
+func DecodeMessageBundleRaw(stream io.Reader) (*MessageBundle, error) {
+	return decodeMessageBundle(stream, true, nil)
+}
+
+// decodeMessageBundle decodes a bundle, sending diagnostics to logger, and the
+// bundle itself at debug level.
+func decodeMessageBundle(stream io.Reader, raw bool, logger *slog.Logger) (*MessageBundle, error) {
 
 	cxt := NewDecoder(stream, 0)
-	cxt.RegisterType("flex.messaging.messages.RemotingMessage", FlexRemotingMessage{})
+	cxt.Logger = logger
+	cxt.skipMemberErrors = true
+	cxt.RegisterType(remotingMessageClass, FlexRemotingMessage{})
+	cxt.RegisterType(commandMessageClass, FlexCommandMessage{})
+	cxt.RegisterType(errorMessageClass, FlexErrorMessage{})
 
 	amfVersion := cxt.ReadUint16()
 
@@ -92,11 +172,17 @@ func DecodeMessageBundle(stream io.Reader) (*MessageBundle, error) {
 	   whether the message was sent in AMF0 or AMF3.
 	*/
 
+	if cxt.errored() {
+		return nil, cxt.decodeError
+	}
 	if cxt.AmfVersion > 0x09 {
 		return nil, errors.New("Malformed stream (wrong amfVersion)")
 	}
 
 	headerCount := cxt.ReadUint16()
+	if cxt.errored() {
+		return nil, cxt.decodeError
+	}
 
 	/*
 	   From http://osflash.org/documentation/amf/envelopes/remoting:
@@ -117,11 +203,18 @@ func DecodeMessageBundle(stream io.Reader) (*MessageBundle, error) {
 		data_len := cxt.ReadUint32()
 		unused(data_len)
 
-		value := cxt.ReadValue()
+		var value interface{}
+		if raw {
+			value = cxt.ReadRawValue()
+		} else {
+			value = cxt.ReadValue()
+		}
+		if cxt.errored() {
+			return nil, cxt.decodeError
+		}
 		header := Header{name, mustUnderstand, value}
 		result.Headers[i] = header
 
-		//fmt.Printf("Read header, name = %s\n", name)
 	}
 
 	/*
@@ -138,63 +231,63 @@ func DecodeMessageBundle(stream io.Reader) (*MessageBundle, error) {
 
 	// Read message bodies
 	messageCount := cxt.ReadUint16()
+	if cxt.errored() {
+		return nil, cxt.decodeError
+	}
 	result.Messages = make([]AmfMessage, messageCount)
 
 	for i := 0; i < int(messageCount); i++ {
-		// TODO: Should reset object tables here
-		cxt.Clear()
+		// Reference tables are per message body; registered types are kept.
+		cxt.resetStream()
 
 		message := &result.Messages[i]
 
 		_, message.TargetUri = cxt.ReadString()
 		_, message.ResponseUri = cxt.ReadString()
 
-		status := "STATUS_OK"
+		// Replies are sent to the response URI of the request followed by the
+		// status, such as /1/onResult. The target is kept whole, so that replies
+		// can be matched with their requests.
 		is_request := true
-		for code, s := range STATUS_CODES {
-			if !strings.HasSuffix(message.TargetUri, s) {
-				continue
+		for _, s := range STATUS_CODES {
+			if strings.HasSuffix(message.TargetUri, s) {
+				is_request = false
 			}
-			is_request = false
-			status = code
-			message.TargetUri = message.TargetUri[len(message.TargetUri)-len(s)+1 : len(message.TargetUri)]
-			_ = status
 		}
 
-		//fmt.Println(message)
 		messageLength := cxt.ReadUint32()
 		// TODO: Check targetUri to see if this isn't an array?
 
-		if is_request {
-			// Read an array, however this array is strange because it doesn't use
-			// the reference bit.
-			typeCode := cxt.ReadUint8()
-			if typeCode != 9 && amfVersion == 3 {
-				return nil, errors.New("Expected Array type code in message body")
-			}
-			if typeCode != 10 && amfVersion == 0 {
+		if raw {
+			message.Body = cxt.ReadRawValue()
+		} else {
+			message.Body = cxt.ReadValue()
+
+			// Request bodies are an AMF0 strict array of arguments.
+			if _, ok := message.Body.([]interface{}); is_request && !ok && !cxt.errored() {
 				return nil, errors.New("Expected Array type code in message body")
 			}
+		}
 
-			ref := cxt.ReadUint32()
-			itemCount := int(ref)
-			args := make([]interface{}, itemCount)
-			for i := 0; i < itemCount; i++ {
-				args[i] = cxt.ReadValue()
-			}
-			message.Body = args
-		} else {
-			message.Body = cxt.ReadValue()
+		if cxt.errored() {
+			return nil, cxt.decodeError
 		}
 
 		unused(messageLength)
 	}
 
+	if debugEnabled(logger) {
+		logger.Debug("decoded AMF envelope", "bundle", &result)
+	}
 	return &result, nil
 }
 
-// Encode message for http request
+// Encode message for http request. The bundle is logged at debug level to the
+// encoder's Logger.
 func EncodeMessageBundle(cxt *Encoder, bundle *MessageBundle) error {
+	if debugEnabled(cxt.Logger) {
+		cxt.Logger.Debug("encoding AMF envelope", "bundle", bundle)
+	}
 	cxt.WriteUint16(bundle.AmfVersion)
 
 	// Write headers
@@ -202,12 +295,29 @@ func EncodeMessageBundle(cxt *Encoder, bundle *MessageBundle) error {
 	for _, header := range bundle.Headers {
 		// cxt.WriteUint16(uint16(len(header.Name)))
 		cxt.WriteString(header.Name)
-		// cxt.WriteBool(header.MustUnderstand)
 
-		cxt.stream.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x28, 0x02, 0x00, 0x25,
-			0x3f, 0x50, 0x48, 0x50, 0x53, 0x45, 0x53, 0x53, 0x49, 0x44, 0x3d, 0x35, 0x65, 0x69, 0x74, 0x33,
-			0x74, 0x6d, 0x63, 0x66, 0x64, 0x71, 0x6f, 0x69, 0x32, 0x76, 0x64, 0x6c, 0x71, 0x72, 0x68, 0x72,
-			0x73, 0x72, 0x6b, 0x31, 0x30})
+		mustUnderstand := uint8(0)
+		if header.MustUnderstand {
+			mustUnderstand = 1
+		}
+
+		if raw, ok := rawValueOf(header.Value); ok {
+			cxt.WriteUint8(mustUnderstand)
+			cxt.WriteUint32(uint32(len(raw.Bytes)))
+			cxt.WriteRawValue(raw)
+			continue
+		}
+
+		// Header values are AMF0, preceded by their length.
+		value := bytes.NewBuffer(make([]byte, 0))
+		headerEncoder := NewEncoder(value)
+		headerEncoder.Logger = cxt.Logger
+		if err := headerEncoder.WriteValueAmf0(header.Value); err != nil {
+			return err
+		}
+		cxt.WriteUint8(mustUnderstand)
+		cxt.WriteUint32(uint32(value.Len()))
+		cxt.stream.Write(value.Bytes())
 	}
 
 	// Write messages
@@ -215,11 +325,30 @@ func EncodeMessageBundle(cxt *Encoder, bundle *MessageBundle) error {
 	for _, message := range bundle.Messages {
 		cxt.WriteString(message.TargetUri)
 		cxt.WriteString(message.ResponseUri)
-		// cxt.WriteUint32(0)
-		// cxt.WriteUint8(0x0a)
-		cxt.WriteUint32(0x01) // message body length
-		cxt.WriteUint8(0x11)  // type amf3
-		cxt.WriteValueAmf3(message.Body)
+
+		if raw, ok := rawValueOf(message.Body); ok {
+			cxt.WriteUint32(uint32(len(raw.Bytes)))
+			cxt.WriteRawValue(raw)
+			continue
+		}
+
+		// Bodies are AMF3 (behind the AMF0 avmplus marker), except in AMF0
+		// bundles. The length is only known once the body is encoded.
+		body := bytes.NewBuffer(make([]byte, 0))
+		encoder := NewEncoder(body)
+		encoder.Logger = cxt.Logger
+		var err error
+		if bundle.AmfVersion == 0 {
+			err = encoder.WriteValueAmf0(message.Body)
+		} else {
+			encoder.WriteUint8(amf0_avmPlusObjectType)
+			err = encoder.WriteValueAmf3(message.Body)
+		}
+		if err != nil {
+			return err
+		}
+		cxt.WriteUint32(uint32(body.Len()))
+		cxt.stream.Write(body.Bytes())
 	}
 
 	return nil
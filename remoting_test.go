@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -89,22 +90,22 @@ func TestDecodeExampleRequest(t *testing.T) {
 	}
 }
 
-func TestDecodeExampleRequest2(t *testing.T) {
+// Another example request generated by the Pinta tool. This one
+// has arguments in it.
+const exampleRequest2 = "00030000000100046e756c6c00022f340000012a0a0000000" +
+	"1110a81134f666c65782e6d6573736167696e672e6d657373616765732e52656d6f7" +
+	"4696e674d6573736167650d736f75726365136f7065726174696f6e136d657373616" +
+	"765496411636c69656e7449641574696d65546f4c6976650f6865616465727313746" +
+	"96d657374616d7009626f64791764657374696e6174696f6e06136d7953657276696" +
+	"36506116d794d6574686f64064939314233453136372d443335412d373542462d363" +
+	"245362d314345393842433432434446064964333462613438662d666438362d34313" +
+	"5392d383035662d33363730656438343733343004000a0b01154453456e64706f696" +
+	"e7401094453496406076e696c0104000907010609747275650603350a05096361747" +
+	"30405096e616d65060753616d01060d616d66706870"
 
-	// Another example request generated by the Pinta tool. This one
-	// has arguments in it.
-	const exampleRequest = "00030000000100046e756c6c00022f340000012a0a0000000" +
-		"1110a81134f666c65782e6d6573736167696e672e6d657373616765732e52656d6f7" +
-		"4696e674d6573736167650d736f75726365136f7065726174696f6e136d657373616" +
-		"765496411636c69656e7449641574696d65546f4c6976650f6865616465727313746" +
-		"96d657374616d7009626f64791764657374696e6174696f6e06136d7953657276696" +
-		"36506116d794d6574686f64064939314233453136372d443335412d373542462d363" +
-		"245362d314345393842433432434446064964333462613438662d666438362d34313" +
-		"5392d383035662d33363730656438343733343004000a0b01154453456e64706f696" +
-		"e7401094453496406076e696c0104000907010609747275650603350a05096361747" +
-		"30405096e616d65060753616d01060d616d66706870"
+func TestDecodeExampleRequest2(t *testing.T) {
 
-	bundle, err := decodeMessageBundleFromHex(exampleRequest)
+	bundle, err := decodeMessageBundleFromHex(exampleRequest2)
 
 	if err != nil {
 		t.Errorf("DecodeMessageBundle returned error: %v", err)
@@ -142,7 +143,98 @@ func TestDecodeExampleRequest2(t *testing.T) {
 	}
 
 	bodyStr := fmt.Sprintf("%v", frm.Body)
-	if bodyStr != "[true 5 map[name:Sam cats:5]]" {
+	if bodyStr != "[true 5 map[cats:5 name:Sam]]" {
 		t.Errorf("Wrong message body: %s", bodyStr)
 	}
 }
+
+func TestDecodeMessageBundleRaw(t *testing.T) {
+	requestBinary, _ := hex.DecodeString(exampleRequest2)
+
+	bundle, err := DecodeMessageBundleRaw(bytes.NewBuffer(requestBinary))
+	if err != nil {
+		t.Fatalf("DecodeMessageBundleRaw returned error: %v", err)
+	}
+
+	raw, ok := bundle.Messages[0].Body.(RawValue)
+	if !ok {
+		t.Fatalf("Message body is not a RawValue: %v", bundle.Messages[0].Body)
+	}
+
+	body, err := raw.Decode()
+	if err != nil {
+		t.Fatalf("RawValue.Decode returned error: %v", err)
+	}
+	bodyArray, ok := body.([]interface{})
+	if !ok || len(bodyArray) != 1 {
+		t.Fatalf("Couldn't cast to array: %v", body)
+	}
+	if frm, ok := bodyArray[0].(FlexRemotingMessage); !ok || frm.Operation != "myMethod" {
+		t.Errorf("Wrong decoded body: %v", bodyArray[0])
+	}
+
+	// The raw body is written back untouched.
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := EncodeMessageBundle(NewEncoder(buffer), bundle); err != nil {
+		t.Fatalf("EncodeMessageBundle returned error: %v", err)
+	}
+	if !bytes.Equal(buffer.Bytes(), requestBinary) {
+		t.Errorf("Re-encoded bundle %x didn't match original %s", buffer.Bytes(), exampleRequest2)
+	}
+}
+
+func TestDecodeTruncatedLongString(t *testing.T) {
+	// A body claiming a 4 GB long string.
+	if _, err := decodeMessageBundleFromHex("000300000001000161000162000000000cffffffff"); err == nil {
+		t.Errorf("Expected an error for a truncated long string")
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	// A message whose body is the given AMF3 value.
+	message := func(body string) string {
+		return "00030000000100016100016200000000" + "11" + body
+	}
+
+	// Arrays nested 100000 deep.
+	nested := strings.Repeat("090301", 100000) + "01"
+	if _, err := decodeMessageBundleFromHex(message(nested)); err == nil ||
+		!strings.Contains(err.Error(), "nested deeper") {
+		t.Errorf("Expected an error for values nested too deep, got %v", err)
+	}
+
+	// An array and a class claiming 268435455 elements and properties.
+	for _, body := range []string{"09ffffffff01", "0afffffffb01"} {
+		if _, err := decodeMessageBundleFromHex(message(body)); err == nil ||
+			!strings.Contains(err.Error(), "beyond the end") {
+			t.Errorf("Expected an error for %s, got %v", body, err)
+		}
+	}
+}
+
+func TestDecodeMessageMemberErrors(t *testing.T) {
+	// An ErrorMessage whose timestamp has the wrong type.
+	bundle := MessageBundle{AmfVersion: 3, Messages: []AmfMessage{{
+		TargetUri:   "/1/onStatus",
+		ResponseUri: "",
+		Body: AvmObject{
+			Class: &AvmClass{Name: errorMessageClass,
+				Properties: []string{"faultCode", "timestamp"}},
+			StaticFields: map[string]interface{}{"faultCode": "Server.Processing",
+				"timestamp": "yesterday"},
+		},
+	}}}
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := EncodeMessageBundle(NewEncoder(buffer), &bundle); err != nil {
+		t.Fatalf("EncodeMessageBundle returned error: %v", err)
+	}
+
+	decoded, err := DecodeMessageBundle(buffer)
+	if err != nil {
+		t.Fatalf("DecodeMessageBundle returned error: %v", err)
+	}
+	message, ok := decoded.Messages[0].Body.(FlexErrorMessage)
+	if !ok || message.FaultCode != "Server.Processing" || message.Timestamp != 0 {
+		t.Errorf("Wrong message: %+v", decoded.Messages[0].Body)
+	}
+}
@@ -0,0 +1,67 @@
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Result is the reply to one message of a request.
+type Result struct {
+	Message AmfMessage
+}
+
+// Decode decodes the result into the value pointed to by v, as Client.Call
+// does. Error replies are returned as *FaultError.
+func (r Result) Decode(v interface{}) error {
+	return decodeReply(r.Message, v)
+}
+
+// Err returns the fault of an error reply, or nil.
+func (r Result) Err() error {
+	return decodeReply(r.Message, nil)
+}
+
+// ReadResults decodes the body of a response, and returns its replies ordered by
+// response URI: the reply to /1 first, then the reply to /2...
+func ReadResults(b []byte) ([]Result, error) {
+	bundle, err := DecodeMessageBundle(bytes.NewBuffer(b))
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, len(bundle.Messages))
+	for i, message := range bundle.Messages {
+		results[i] = Result{message}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		a, _ := replyIndex(results[i].Message.TargetUri)
+		b, _ := replyIndex(results[j].Message.TargetUri)
+		return a < b
+	})
+	return results, nil
+}
+
+// DecodeResponse decodes the body of a response to a request made with
+// NewRequest, decoding the result of the i-th message into targets[i]. A nil
+// target skips its result. The first error reply is returned as *FaultError,
+// after all results are decoded.
+func DecodeResponse(b []byte, targets ...interface{}) error {
+	results, err := ReadResults(b)
+	if err != nil {
+		return err
+	}
+	if len(results) < len(targets) {
+		return errors.New(fmt.Sprintf("amf: expected %d replies, got %d",
+			len(targets), len(results)))
+	}
+
+	var firstErr error
+	for i, target := range targets {
+		if err := results[i].Decode(target); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
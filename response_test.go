@@ -0,0 +1,63 @@
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDecodeResponse(t *testing.T) {
+	rows := []interface{}{
+		AvmObject{
+			Class:        &AvmClass{Name: "Row", Properties: []string{"name", "size"}},
+			StaticFields: map[string]interface{}{"name": "a", "size": 1},
+		},
+		map[string]interface{}{"name": "b", "size": 2},
+	}
+	bundle := MessageBundle{
+		AmfVersion: 3,
+		Messages: []AmfMessage{
+			{TargetUri: "/3/onStatus", ResponseUri: "null", Body: testErrorMessage("Server.Processing", "failed")},
+			{TargetUri: "/2/onResult", ResponseUri: "null", Body: testAcknowledge(rows)},
+			{TargetUri: "/1/onResult", ResponseUri: "null", Body: testAcknowledge(map[string]interface{}{
+				"id": 7, "tags": []interface{}{"x"}})},
+		},
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	EncodeMessageBundle(NewEncoder(buffer), &bundle)
+
+	var item struct {
+		ID   int
+		Tags []string
+	}
+	var list []struct {
+		Name string
+		Size uint8
+	}
+	err := DecodeResponse(buffer.Bytes(), &item, &list, nil)
+
+	var fault *FaultError
+	if !errors.As(err, &fault) || fault.FaultString != "failed" {
+		t.Errorf("Expected the fault of the third reply, got %v", err)
+	}
+	if item.ID != 7 || fmt.Sprint(item.Tags) != "[x]" {
+		t.Errorf("Wrong first result: %+v", item)
+	}
+	if fmt.Sprint(list) != "[{a 1} {b 2}]" {
+		t.Errorf("Wrong second result: %+v", list)
+	}
+
+	// The compatibility wrapper reports the error reply.
+	if _, err := ParseRespBody(buffer.Bytes()); err == nil {
+		t.Errorf("Expected ParseRespBody to fail")
+	}
+
+	bundle.Messages = bundle.Messages[1:2]
+	buffer.Reset()
+	EncodeMessageBundle(NewEncoder(buffer), &bundle)
+	body, err := ParseRespBody(buffer.Bytes())
+	if err != nil || fmt.Sprint(body) != "[[map[name:a size:1] map[name:b size:2]]]" {
+		t.Errorf("ParseRespBody returned %v, %v", body, err)
+	}
+}
@@ -0,0 +1,149 @@
+package amf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// service is a registered service and its methods.
+type service struct {
+	name    string
+	value   reflect.Value
+	methods map[string]reflect.Method
+
+	// Channels and security constraint of destinations defined by Configure.
+	configured bool
+	channels   []string
+	security   *SecurityConstraint
+}
+
+// Register makes the exported methods of svc callable as operations of the
+// destination name. An operation matches the method of the same name, its first
+// letter in upper case: the operation "findUser" calls FindUser.
+//
+// Methods may take a context.Context as first parameter. The other parameters
+// receive the arguments of the call, converted as by Decoder.Decode. Methods may
+// return a result, an error, or both.
+func (gw *Gateway) Register(name string, svc interface{}) error {
+	value := reflect.ValueOf(svc)
+	if !value.IsValid() {
+		return errors.New("Register called with nil service")
+	}
+	if _, ok := gw.services[name]; ok {
+		return errors.New(fmt.Sprintf("service already registered: %s", name))
+	}
+
+	s := &service{name: name, value: value, methods: make(map[string]reflect.Method)}
+	for i := 0; i < value.Type().NumMethod(); i++ {
+		method := value.Type().Method(i)
+		if err := checkServiceMethod(method.Type); err != nil {
+			return errors.New(fmt.Sprintf("%s.%s: %v", name, method.Name, err))
+		}
+		s.methods[method.Name] = method
+	}
+	if len(s.methods) == 0 {
+		return errors.New(fmt.Sprintf("service %s has no exported methods", name))
+	}
+
+	gw.services[name] = s
+	return nil
+}
+
+// checkServiceMethod checks that a method returns at most a result and an error.
+func checkServiceMethod(methodType reflect.Type) error {
+	switch methodType.NumOut() {
+	case 0, 1:
+		return nil
+	case 2:
+		if methodType.Out(1) == errorType {
+			return nil
+		}
+	}
+	return errors.New("methods must return at most a result and an error")
+}
+
+var (
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// call invokes an operation of a destination.
+func (gw *Gateway) call(ctx context.Context, destination, operation string,
+	args []interface{}) (interface{}, error) {
+
+	s, ok := gw.services[destination]
+	if !ok || gw.configured && !s.configured {
+		return nil, errors.New(fmt.Sprintf("no such destination: %s", destination))
+	}
+
+	method, ok := s.methods[operation]
+	if !ok && operation != "" {
+		method, ok = s.methods[strings.ToUpper(operation[:1])+operation[1:]]
+	}
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("no such operation: %s.%s", destination, operation))
+	}
+
+	in, err := serviceArgs(ctx, method, s.value, args)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s.%s: %v", destination, operation, err))
+	}
+
+	out := method.Func.Call(in)
+
+	var result interface{}
+	if len(out) > 0 && out[len(out)-1].Type() == errorType {
+		if err, _ := out[len(out)-1].Interface().(error); err != nil {
+			return nil, err
+		}
+		out = out[:len(out)-1]
+	}
+	if len(out) > 0 {
+		result = out[0].Interface()
+	}
+	return result, nil
+}
+
+// serviceArgs converts the arguments of a call into the parameters of method.
+func serviceArgs(ctx context.Context, method reflect.Method, receiver reflect.Value,
+	args []interface{}) ([]reflect.Value, error) {
+
+	methodType := method.Type
+	in := []reflect.Value{receiver}
+	if methodType.NumIn() > 1 && methodType.In(1) == contextType {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+
+	if methodType.NumIn()-len(in) != len(args) {
+		return nil, errors.New(fmt.Sprintf("expected %d arguments, got %d",
+			methodType.NumIn()-len(in), len(args)))
+	}
+
+	for i, arg := range args {
+		param := reflect.New(methodType.In(len(in))).Elem()
+		if err := assignValue(param, arg); err != nil {
+			return nil, errors.New(fmt.Sprintf("argument %d: %v", i+1, err))
+		}
+		in = append(in, param)
+	}
+	return in, nil
+}
+
+// amf0Call returns the call of an AMF0 request, whose target URI names the
+// operation, as in "UserService.findUser".
+func amf0Call(request AmfMessage) (*Call, error) {
+	args, _ := request.Body.([]interface{})
+
+	dot := strings.LastIndex(request.TargetUri, ".")
+	if dot < 0 {
+		return nil, errors.New(fmt.Sprintf("no operation in target: %s", request.TargetUri))
+	}
+	return &Call{Message: FlexRemotingMessage{
+		Destination: request.TargetUri[:dot],
+		Operation:   request.TargetUri[dot+1:],
+		Body:        args,
+	}}, nil
+}
@@ -0,0 +1,360 @@
+package amf
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultSessionTimeout is the time sessions of NewGateway last without use.
+const DefaultSessionTimeout = 30 * time.Minute
+
+// DefaultSessionCookie names the session cookie if Gateway.SessionCookie is empty.
+const DefaultSessionCookie = "AMFSESSIONID"
+
+// Longest DSId taken from a client for a new session.
+const maxDSIdLength = 64
+
+// Session holds the state kept for a client across requests, as FlexSession
+// does in BlazeDS. Its methods may be called concurrently.
+//
+// A new session is only stored once it holds something: a value, or the user
+// logged in.
+type Session struct {
+	// ID identifies the session in the session cookie. It is a secret, never
+	// sent in AMF messages.
+	ID string
+
+	// DSId is the id of the client in Flex messages. It identifies the session
+	// of clients that don't keep cookies.
+	DSId string
+
+	mu          sync.Mutex
+	user        string
+	values      map[string]interface{}
+	invalidated bool
+
+	// State of the session in the store: not saved yet, changed since loaded,
+	// and the id it was saved under before a new one was given at login.
+	isNew      bool
+	modified   bool
+	previousID string
+}
+
+// NewSession returns a session, such as one read back by a SessionStore.
+func NewSession(id, dsID, user string, values map[string]interface{}) *Session {
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	return &Session{ID: id, DSId: dsID, user: user, values: values}
+}
+
+// Get returns the value stored under name, or nil.
+func (s *Session) Get(name string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[name]
+}
+
+// Set stores a value under name.
+func (s *Session) Set(name string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[name] = value
+	s.modified = true
+}
+
+// Delete removes the value stored under name.
+func (s *Session) Delete(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, name)
+	s.modified = true
+}
+
+// Values returns a copy of the values of the session.
+func (s *Session) Values() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make(map[string]interface{}, len(s.values))
+	for name, value := range s.values {
+		values[name] = value
+	}
+	return values
+}
+
+// User returns the user logged in, or "".
+func (s *Session) User() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user
+}
+
+// SetUser sets the user logged in. The gateway sets it when LOGIN commands or
+// Credentials headers are accepted, after giving the session new ids.
+func (s *Session) SetUser(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user = user
+	s.modified = true
+}
+
+// Invalidate ends the session once the current request is answered. The gateway
+// invalidates the session on LOGOUT commands.
+func (s *Session) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invalidated = true
+}
+
+func (s *Session) isInvalidated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.invalidated
+}
+
+func (s *Session) isModified() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.modified
+}
+
+// regenerate gives the session new ids, so that ids known before a login, which
+// may have been planted by someone else, are worthless after it.
+func (s *Session) regenerate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.isNew && s.previousID == "" {
+		s.previousID = s.ID
+	}
+	s.ID = newMessageId()
+	s.DSId = newMessageId()
+	s.modified = true
+}
+
+// SessionStore keeps sessions between requests.
+type SessionStore interface {
+	// Get returns the session with the given id, or nil if there is none or it
+	// has expired.
+	Get(ctx context.Context, id string) (*Session, error)
+
+	// GetByDSId returns the session with the given DSId, like Get.
+	GetByDSId(ctx context.Context, dsID string) (*Session, error)
+
+	// Save stores a session after each request that used it, which renews its
+	// expiry.
+	Save(ctx context.Context, session *Session) error
+
+	// Delete removes a session, when it is invalidated or given a new id.
+	Delete(ctx context.Context, id string) error
+}
+
+type sessionKey struct{}
+
+// SessionFromContext returns the session of the call being handled.
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	session, ok := ctx.Value(sessionKey{}).(*Session)
+	return session, ok
+}
+
+// MemoryStore is a SessionStore keeping sessions in memory.
+type MemoryStore struct {
+	// Timeout is how long sessions last without use.
+	Timeout time.Duration
+
+	mu        sync.Mutex
+	sessions  map[string]*memorySession
+	dsIDs     map[string]string
+	lastSweep time.Time
+}
+
+type memorySession struct {
+	session *Session
+	dsID    string
+	expires time.Time
+}
+
+// NewMemoryStore returns a MemoryStore whose sessions expire after timeout
+// without use.
+func NewMemoryStore(timeout time.Duration) *MemoryStore {
+	return &MemoryStore{
+		Timeout:  timeout,
+		sessions: make(map[string]*memorySession),
+		dsIDs:    make(map[string]string),
+	}
+}
+
+func (store *MemoryStore) Get(ctx context.Context, id string) (*Session, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored, ok := store.sessions[id]
+	if !ok || time.Now().After(stored.expires) {
+		return nil, nil
+	}
+	return stored.session, nil
+}
+
+func (store *MemoryStore) GetByDSId(ctx context.Context, dsID string) (*Session, error) {
+	store.mu.Lock()
+	id, ok := store.dsIDs[dsID]
+	store.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return store.Get(ctx, id)
+}
+
+func (store *MemoryStore) Save(ctx context.Context, session *Session) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	if stored, ok := store.sessions[session.ID]; ok && stored.dsID != session.DSId {
+		delete(store.dsIDs, stored.dsID)
+	}
+	store.sessions[session.ID] = &memorySession{session, session.DSId, now.Add(store.Timeout)}
+	store.dsIDs[session.DSId] = session.ID
+
+	// Expired sessions are removed now and then.
+	if now.Sub(store.lastSweep) > store.Timeout/2 {
+		for id, stored := range store.sessions {
+			if now.After(stored.expires) {
+				store.remove(id)
+			}
+		}
+		store.lastSweep = now
+	}
+	return nil
+}
+
+func (store *MemoryStore) Delete(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.remove(id)
+	return nil
+}
+
+// remove deletes a session and its DSId. It must be called with mu held.
+func (store *MemoryStore) remove(id string) {
+	if stored, ok := store.sessions[id]; ok {
+		if store.dsIDs[stored.dsID] == id {
+			delete(store.dsIDs, stored.dsID)
+		}
+		delete(store.sessions, id)
+	}
+}
+
+// loadSession returns the session of a request: the one named by the session
+// cookie, else by the DSId of its first Flex message, else a new one. A new
+// session takes the DSId the client sent, if any, so that clients without
+// cookies keep their DSId until the session is stored. It returns nil if the
+// gateway has no session store.
+func (gw *Gateway) loadSession(ctx context.Context, r *http.Request,
+	bundle *MessageBundle) (*Session, error) {
+
+	if gw.Sessions == nil {
+		return nil, nil
+	}
+
+	if cookie, err := r.Cookie(gw.sessionCookie()); err == nil {
+		session, err := gw.Sessions.Get(ctx, cookie.Value)
+		if err != nil || session != nil {
+			return session, err
+		}
+	}
+
+	dsID := firstDSId(bundle)
+	if dsID == "nil" || len(dsID) > maxDSIdLength {
+		dsID = ""
+	}
+	if dsID != "" {
+		session, err := gw.Sessions.GetByDSId(ctx, dsID)
+		if err != nil || session != nil {
+			return session, err
+		}
+	} else {
+		dsID = newMessageId()
+	}
+
+	session := NewSession(newMessageId(), dsID, "", nil)
+	session.isNew = true
+	return session, nil
+}
+
+// saveSession stores the session after a request if it was used, or deletes it
+// if it was invalidated, and sets the session cookie accordingly.
+func (gw *Gateway) saveSession(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, session *Session) error {
+
+	cookie := &http.Cookie{Name: gw.sessionCookie(), Value: session.ID, Path: "/",
+		HttpOnly: true, Secure: r.TLS != nil}
+
+	if session.previousID != "" {
+		if err := gw.Sessions.Delete(ctx, session.previousID); err != nil {
+			return err
+		}
+		session.previousID = ""
+	}
+
+	if session.isInvalidated() {
+		if !session.isNew {
+			cookie.MaxAge = -1
+			http.SetCookie(w, cookie)
+		}
+		return gw.Sessions.Delete(ctx, session.ID)
+	}
+
+	// New sessions are only kept once they hold something.
+	if session.isNew && !session.isModified() {
+		return nil
+	}
+	if session.isNew || cookieValue(r, gw.sessionCookie()) != session.ID {
+		http.SetCookie(w, cookie)
+	}
+	session.isNew = false
+	return gw.Sessions.Save(ctx, session)
+}
+
+// loginSession gives the session of ctx new ids and sets its user, after a login.
+func loginSession(ctx context.Context, user string) {
+	if session, ok := SessionFromContext(ctx); ok {
+		session.regenerate()
+		session.SetUser(user)
+	}
+}
+
+func cookieValue(r *http.Request, name string) string {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func (gw *Gateway) sessionCookie() string {
+	if gw.SessionCookie == "" {
+		return DefaultSessionCookie
+	}
+	return gw.SessionCookie
+}
+
+// firstDSId returns the DSId header of the first Flex message of a bundle.
+func firstDSId(bundle *MessageBundle) string {
+	for _, message := range bundle.Messages {
+		args, _ := message.Body.([]interface{})
+		if len(args) != 1 {
+			continue
+		}
+		switch message := args[0].(type) {
+		case FlexRemotingMessage:
+			dsID, _ := message.Headers["DSId"].(string)
+			return dsID
+		case FlexCommandMessage:
+			dsID, _ := message.Headers["DSId"].(string)
+			return dsID
+		}
+	}
+	return ""
+}
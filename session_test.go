@@ -0,0 +1,161 @@
+package amf
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type testCounter struct{}
+
+func (testCounter) Incr(ctx context.Context) (int, error) {
+	session, ok := SessionFromContext(ctx)
+	if !ok {
+		return 0, errors.New("no session")
+	}
+	count, _ := session.Get("count").(int)
+	session.Set("count", count+1)
+	return count + 1, nil
+}
+
+func (testCounter) Whoami(ctx context.Context) string {
+	session, _ := SessionFromContext(ctx)
+	return session.User()
+}
+
+func TestGatewaySessions(t *testing.T) {
+	gw := NewGateway()
+	gw.Register("Counter", testCounter{})
+	gw.Authenticate = func(ctx context.Context, username, password string) error {
+		return nil
+	}
+	server := httptest.NewServer(gw)
+	defer server.Close()
+	ctx := context.Background()
+
+	incr := func(client *Client, expected int) {
+		var count int
+		if err := client.Call(ctx, "Counter", "incr", &count); err != nil || count != expected {
+			t.Errorf("incr returned %d, %v, expected %d", count, err, expected)
+		}
+	}
+
+	// Sessions are found by cookie, or by DSId for clients without cookies.
+	client := NewClient(server.URL)
+	incr(client, 1)
+	incr(client, 2)
+	if client.DSId() == "" {
+		t.Errorf("The session wasn't given as DSId")
+	}
+	incr(NewClient(server.URL), 1)
+	noCookies := NewClient(server.URL)
+	noCookies.HTTPClient = &http.Client{}
+	incr(noCookies, 1)
+	incr(noCookies, 2)
+
+	// Login sets the user of the session, and logout ends it.
+	if err := client.Login(ctx, "sam", "secret"); err != nil {
+		t.Fatalf("Login returned error: %v", err)
+	}
+	var user string
+	if err := client.Call(ctx, "Counter", "whoami", &user); err != nil || user != "sam" {
+		t.Errorf("whoami returned %q, %v", user, err)
+	}
+	incr(client, 3)
+	if err := client.Logout(ctx); err != nil {
+		t.Fatalf("Logout returned error: %v", err)
+	}
+	incr(client, 1)
+}
+
+func TestGatewaySessionIds(t *testing.T) {
+	gw := NewGateway()
+	store := NewMemoryStore(time.Minute)
+	gw.Sessions = store
+	gw.Register("Counter", testCounter{})
+	gw.Authenticate = func(ctx context.Context, username, password string) error {
+		return nil
+	}
+	server := httptest.NewServer(gw)
+	defer server.Close()
+	ctx := context.Background()
+
+	// Sessions are only stored once used.
+	client := NewClient(server.URL)
+	var user string
+	if err := client.Call(ctx, "Counter", "whoami", &user); err != nil {
+		t.Fatalf("whoami returned error: %v", err)
+	}
+	if len(store.sessions) != 0 {
+		t.Errorf("Expected no session to be stored, got %d", len(store.sessions))
+	}
+
+	serverURL, _ := url.Parse(server.URL)
+	cookie := func() string {
+		for _, c := range client.HTTPClient.Jar.Cookies(serverURL) {
+			if c.Name == DefaultSessionCookie {
+				return c.Value
+			}
+		}
+		return ""
+	}
+	var count int
+	if err := client.Call(ctx, "Counter", "incr", &count); err != nil {
+		t.Fatalf("incr returned error: %v", err)
+	}
+	if len(store.sessions) != 1 || cookie() == "" {
+		t.Fatalf("Expected the session to be stored, got %d sessions", len(store.sessions))
+	}
+	if client.DSId() == cookie() {
+		t.Errorf("The session cookie was sent as DSId")
+	}
+
+	// Login gives the session new ids.
+	id, dsID := cookie(), client.DSId()
+	if err := client.Login(ctx, "sam", "secret"); err != nil {
+		t.Fatalf("Login returned error: %v", err)
+	}
+	if cookie() == id || client.DSId() == dsID {
+		t.Errorf("The session kept its ids at login")
+	}
+	if found, _ := store.Get(ctx, id); found != nil {
+		t.Errorf("The session is still stored under its former id")
+	}
+	if found, _ := store.GetByDSId(ctx, dsID); found != nil {
+		t.Errorf("The session is still found by its former DSId")
+	}
+	if err := client.Call(ctx, "Counter", "incr", &count); err != nil || count != 2 {
+		t.Errorf("incr returned %d, %v, expected 2", count, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(20 * time.Millisecond)
+	session := NewSession("S1", "D1", "sam", map[string]interface{}{"a": 1})
+	store.Save(ctx, session)
+
+	if found, err := store.Get(ctx, "S1"); err != nil || found != session {
+		t.Errorf("Get returned %v, %v", found, err)
+	}
+	if found, err := store.GetByDSId(ctx, "D1"); err != nil || found != session {
+		t.Errorf("GetByDSId returned %v, %v", found, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if found, err := store.Get(ctx, "S1"); err != nil || found != nil {
+		t.Errorf("Expected the session to expire, got %v, %v", found, err)
+	}
+
+	store.Save(ctx, session)
+	store.Delete(ctx, "S1")
+	if found, _ := store.Get(ctx, "S1"); found != nil {
+		t.Errorf("Expected the session to be deleted, got %v", found)
+	}
+	if found, _ := store.GetByDSId(ctx, "D1"); found != nil {
+		t.Errorf("Expected the DSId to be deleted, got %v", found)
+	}
+}
@@ -0,0 +1,361 @@
+package amf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// TokenKind identifies the kind of event returned by Decoder.Next.
+type TokenKind int
+
+const (
+	// Value is a scalar value (nil, bool, number, string, date).
+	Value TokenKind = iota
+	// Reference is a reference to an array or object that appeared earlier in the
+	// stream. Token.Ref holds its index in the object table.
+	Reference
+	// ArrayStart begins an array. Token.Len holds the number of dense elements.
+	ArrayStart
+	// ArrayEnd closes the innermost array.
+	ArrayEnd
+	// ObjectStart begins an object. Token.Class holds its class definition.
+	ObjectStart
+	// ObjectEnd closes the innermost object.
+	ObjectEnd
+	// Field names the member (or associative array key) whose value follows.
+	Field
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case Value:
+		return "Value"
+	case Reference:
+		return "Reference"
+	case ArrayStart:
+		return "ArrayStart"
+	case ArrayEnd:
+		return "ArrayEnd"
+	case ObjectStart:
+		return "ObjectStart"
+	case ObjectEnd:
+		return "ObjectEnd"
+	case Field:
+		return "Field"
+	}
+	return fmt.Sprintf("TokenKind(%d)", int(k))
+}
+
+// A Token is a single event in an AMF3 value stream.
+type Token struct {
+	Kind TokenKind
+
+	// Scalar value for Value tokens. For Reference tokens this is the referenced
+	// value if it was materialized (by ReadValueAmf3 or DecodeNext), or nil if it
+	// was streamed.
+	Value interface{}
+
+	// Member name for Field tokens.
+	Name string
+
+	// Class definition for ObjectStart tokens.
+	Class *AvmClass
+
+	// Number of dense elements for ArrayStart tokens.
+	Len int
+
+	// Object table index for ArrayStart, ObjectStart and Reference tokens. A
+	// Reference token with Ref n points to the container started by the
+	// ArrayStart or ObjectStart token with the same Ref.
+	Ref int
+}
+
+// Stream frame kinds.
+const (
+	frameArray = iota
+	frameObject
+	frameExternal
+)
+
+// streamFrame tracks the position inside an array or object while streaming.
+type streamFrame struct {
+	kind  int
+	class *AvmClass
+
+	// Remaining dense elements (arrays).
+	remaining int
+
+	// Next sealed property (objects).
+	property int
+
+	// Set once the associative part of an array, or the sealed part of an object,
+	// has been consumed.
+	sealedDone bool
+
+	// Set after a Field token, when the member value comes next.
+	valueDue bool
+
+	// Associative key read ahead by DecodeNext, to be returned by Next.
+	pendingField string
+
+	// Set once the wrapped value of an externalizable object has been read.
+	externalDone bool
+}
+
+// Next reads the next token from an AMF3 stream.
+//
+// Containers are not materialized: arrays and objects are reported as
+// ArrayStart/ObjectStart, followed by their members and a closing
+// ArrayEnd/ObjectEnd. Strings and class definitions are still kept in the
+// reference tables, and every container reserves its slot in the object table so
+// that later references (reported as Reference tokens) resolve to the right
+// index. Only the slot is kept, not the container, so memory use does not grow
+// with the size of the rows being streamed.
+//
+// Externalizable objects are supported only for classes that wrap a single
+// value, such as flex.messaging.io.ArrayCollection; the wrapped value is
+// reported between ObjectStart and ObjectEnd.
+//
+// Next returns io.EOF when the stream ends between top-level values, and
+// io.ErrUnexpectedEOF when it ends inside one.
+func (cxt *Decoder) Next() (Token, error) {
+	token, err := cxt.next()
+	if err == io.EOF && cxt.decodeError == io.EOF {
+		cxt.decodeError = io.ErrUnexpectedEOF
+		err = cxt.decodeError
+	}
+	return token, err
+}
+
+func (cxt *Decoder) next() (Token, error) {
+	if cxt.errored() {
+		return Token{}, cxt.decodeError
+	}
+
+	if len(cxt.frames) == 0 {
+		return cxt.nextTopLevelToken()
+	}
+
+	frame := &cxt.frames[len(cxt.frames)-1]
+
+	if frame.valueDue {
+		frame.valueDue = false
+		return cxt.finishToken(cxt.readValueToken())
+	}
+
+	if frame.pendingField != "" {
+		name := frame.pendingField
+		frame.pendingField = ""
+		frame.valueDue = true
+		return Token{Kind: Field, Name: name}, nil
+	}
+
+	switch frame.kind {
+	case frameArray:
+		if !frame.sealedDone {
+			key := cxt.readStringAmf3()
+			if cxt.errored() {
+				return Token{}, cxt.decodeError
+			}
+			if key != "" {
+				frame.valueDue = true
+				return Token{Kind: Field, Name: key}, nil
+			}
+			frame.sealedDone = true
+		}
+		if frame.remaining > 0 {
+			frame.remaining--
+			return cxt.finishToken(cxt.readValueToken())
+		}
+		cxt.frames = cxt.frames[:len(cxt.frames)-1]
+		return Token{Kind: ArrayEnd}, nil
+
+	case frameObject:
+		if !frame.sealedDone {
+			if frame.property < len(frame.class.Properties) {
+				name := frame.class.Properties[frame.property]
+				frame.property++
+				frame.valueDue = true
+				return Token{Kind: Field, Name: name}, nil
+			}
+			frame.sealedDone = true
+		}
+		if frame.class.Dynamic {
+			name := cxt.readStringAmf3()
+			if cxt.errored() {
+				return Token{}, cxt.decodeError
+			}
+			if name != "" {
+				frame.valueDue = true
+				return Token{Kind: Field, Name: name}, nil
+			}
+		}
+		cxt.frames = cxt.frames[:len(cxt.frames)-1]
+		return Token{Kind: ObjectEnd}, nil
+
+	case frameExternal:
+		if !frame.externalDone {
+			frame.externalDone = true
+			return cxt.finishToken(cxt.readValueToken())
+		}
+		cxt.frames = cxt.frames[:len(cxt.frames)-1]
+		return Token{Kind: ObjectEnd}, nil
+	}
+
+	return Token{}, errors.New("Next: corrupt stream state")
+}
+
+// DecodeNext reads the next value of the current container and returns it fully
+// materialized, as ReadValueAmf3 would. It lets callers stream the outer array
+// with Next and decode each row individually. It fails if the next token would
+// be a Field or a closing token.
+//
+// The values DecodeNext returns are kept in the object table, as later values
+// may refer to them, so memory grows with the number of rows decoded this way;
+// only rows read with Next keep memory constant. References to containers being
+// streamed, which are not materialized, decode as nil.
+func (cxt *Decoder) DecodeNext() (interface{}, error) {
+	if cxt.errored() {
+		return nil, cxt.decodeError
+	}
+
+	if len(cxt.frames) > 0 {
+		frame := &cxt.frames[len(cxt.frames)-1]
+
+		// Skip the end of the associative part, if that is all that separates us
+		// from the dense elements.
+		if frame.kind == frameArray && !frame.sealedDone && !frame.valueDue &&
+			frame.pendingField == "" {
+			key := cxt.readStringAmf3()
+			if cxt.errored() {
+				return nil, cxt.decodeError
+			}
+			if key != "" {
+				frame.pendingField = key
+				return nil, errors.New("DecodeNext: next token is not a value")
+			}
+			frame.sealedDone = true
+		}
+
+		switch {
+		case frame.valueDue:
+			frame.valueDue = false
+		case frame.kind == frameArray && frame.sealedDone && frame.remaining > 0:
+			frame.remaining--
+		case frame.kind == frameExternal && !frame.externalDone:
+			frame.externalDone = true
+		default:
+			return nil, errors.New("DecodeNext: next token is not a value")
+		}
+	}
+
+	value := cxt.ReadValueAmf3()
+	return value, cxt.decodeError
+}
+
+// Depth returns the number of containers that are currently open.
+func (cxt *Decoder) Depth() int {
+	return len(cxt.frames)
+}
+
+func (cxt *Decoder) nextTopLevelToken() (Token, error) {
+	// Distinguish a clean end of stream from a truncated value.
+	buf := make([]byte, 1)
+	n, err := io.ReadFull(cxt.stream, buf)
+	if n == 0 && err == io.EOF {
+		return Token{}, io.EOF
+	}
+	cxt.saveError(err)
+	if cxt.errored() {
+		return Token{}, cxt.decodeError
+	}
+	return cxt.finishToken(cxt.readValueTokenWithMarker(buf[0]))
+}
+
+func (cxt *Decoder) finishToken(token Token) (Token, error) {
+	if cxt.errored() {
+		return Token{}, cxt.decodeError
+	}
+	return token, nil
+}
+
+func (cxt *Decoder) readValueToken() Token {
+	typeMarker := cxt.ReadByte()
+	if cxt.errored() {
+		return Token{}
+	}
+	return cxt.readValueTokenWithMarker(typeMarker)
+}
+
+func (cxt *Decoder) readValueTokenWithMarker(typeMarker uint8) Token {
+	if typeMarker == amf0_avmPlusObjectType {
+		typeMarker = cxt.ReadByte()
+		if cxt.errored() {
+			return Token{}
+		}
+	}
+
+	switch typeMarker {
+	case amf3_arrayType:
+		return cxt.readArrayToken()
+	case amf3_objectType:
+		return cxt.readObjectToken()
+	}
+
+	return Token{Kind: Value, Value: cxt.readValueAmf3WithMarker(typeMarker)}
+}
+
+func (cxt *Decoder) readReferenceToken(ref uint32) Token {
+	index := int(ref >> 1)
+	if index >= len(cxt.objectTable) {
+		cxt.saveError(errors.New(fmt.Sprintf("Invalid object index: %d", index)))
+		return Token{}
+	}
+	return Token{Kind: Reference, Ref: index, Value: cxt.objectTable[index]}
+}
+
+func (cxt *Decoder) readArrayToken() Token {
+	ref := cxt.ReadUint29()
+	if cxt.errored() {
+		return Token{}
+	}
+
+	if (ref & REFERENCE_BIT) == 0 {
+		return cxt.readReferenceToken(ref)
+	}
+
+	// Reserve the slot; the array itself is not kept.
+	index := len(cxt.objectTable)
+	cxt.storeObjectInTable(nil)
+
+	elementCount := int(ref >> 1)
+	cxt.frames = append(cxt.frames, streamFrame{kind: frameArray, remaining: elementCount})
+	return Token{Kind: ArrayStart, Len: elementCount, Ref: index}
+}
+
+func (cxt *Decoder) readObjectToken() Token {
+	ref := cxt.ReadUint29()
+	if cxt.errored() {
+		return Token{}
+	}
+
+	if (ref & REFERENCE_BIT) == 0 {
+		return cxt.readReferenceToken(ref)
+	}
+
+	class := cxt.readClassDefinitionAmf3(ref)
+	if cxt.errored() {
+		return Token{}
+	}
+
+	index := len(cxt.objectTable)
+	cxt.storeObjectInTable(nil)
+
+	kind := frameObject
+	if class.Externalizable {
+		kind = frameExternal
+	}
+	cxt.frames = append(cxt.frames, streamFrame{kind: kind, class: class})
+	return Token{Kind: ObjectStart, Class: class, Ref: index}
+}
@@ -0,0 +1,137 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func testStreamAmf3(t *testing.T, blobStr string, expected string) {
+	blob, _ := hex.DecodeString(blobStr)
+	cxt := NewDecoder(bytes.NewBuffer(blob), 3)
+
+	var tokens []string
+	for {
+		token, err := cxt.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Errorf("Received error while streaming %s: %v", blobStr, err)
+			return
+		}
+		switch token.Kind {
+		case Value:
+			tokens = append(tokens, fmt.Sprintf("%v", token.Value))
+		case Field:
+			tokens = append(tokens, token.Name+":")
+		case ArrayStart:
+			tokens = append(tokens, fmt.Sprintf("[%d#%d", token.Len, token.Ref))
+		case ObjectStart:
+			tokens = append(tokens, fmt.Sprintf("{%s#%d", token.Class.Name, token.Ref))
+		case Reference:
+			tokens = append(tokens, fmt.Sprintf("ref#%d", token.Ref))
+		case ArrayEnd:
+			tokens = append(tokens, "]")
+		case ObjectEnd:
+			tokens = append(tokens, "}")
+		}
+	}
+
+	result := strings.Join(tokens, " ")
+	if result != expected {
+		t.Errorf("Stream result of '%s' didn't match expected '%s' for binary blob %s",
+			result, expected, blobStr)
+	}
+}
+
+func TestStreamValues(t *testing.T) {
+	testStreamAmf3(t, "0401060b48656c6c6f03", "1 Hello true")
+	testStreamAmf3(t, "090701040104020403", "[3#0 1 2 3 ]")
+
+	// Mixed array
+	testStreamAmf3(t, "09070361060b6170706c650362060d62616e616e6101040104020403",
+		"[3#0 a: apple b: banana 1 2 3 ]")
+}
+
+func TestStreamObjects(t *testing.T) {
+	// An array of two anonymous objects sharing a class definition, followed by a
+	// reference to the first one.
+	testStreamAmf3(t, "0907010a1301036104010a0104020a02",
+		"[3#0 {#1 a: 1 } {#2 a: 2 } ref#1 ]")
+
+	// Dynamic object inside an externalizable wrapper.
+	testStreamAmf3(t, "0a0743666c65782e6d6573736167696e672e696f2e4172726179436f6c6c656374696f6e"+
+		"0903010a0b01036206037801",
+		"{flex.messaging.io.ArrayCollection#0 [1#1 {#2 b: x } ] }")
+}
+
+func TestStreamDecodeNext(t *testing.T) {
+	blob, _ := hex.DecodeString("09070361040101040204030404")
+	cxt := NewDecoder(bytes.NewBuffer(blob), 3)
+
+	if token, err := cxt.Next(); err != nil || token.Kind != ArrayStart {
+		t.Fatalf("Expected ArrayStart, got %v (%v)", token.Kind, err)
+	}
+	if token, err := cxt.Next(); err != nil || token.Kind != Field || token.Name != "a" {
+		t.Fatalf("Expected Field a, got %v (%v)", token.Kind, err)
+	}
+	for _, expected := range []string{"1", "2", "3", "4"} {
+		value, err := cxt.DecodeNext()
+		if err != nil {
+			t.Fatalf("DecodeNext returned error: %v", err)
+		}
+		if fmt.Sprintf("%v", value) != expected {
+			t.Errorf("DecodeNext returned %v, expected %s", value, expected)
+		}
+	}
+	if _, err := cxt.DecodeNext(); err == nil {
+		t.Error("Expected error from DecodeNext past the end of the array")
+	}
+	if token, err := cxt.Next(); err != nil || token.Kind != ArrayEnd {
+		t.Errorf("Expected ArrayEnd, got %v (%v)", token.Kind, err)
+	}
+	if cxt.Depth() != 0 {
+		t.Errorf("Wrong depth after ArrayEnd: %d", cxt.Depth())
+	}
+}
+
+func TestStreamDecodeNextReferences(t *testing.T) {
+	// An array holding an object whose member refers to the array, then the
+	// array itself.
+	blob, _ := hex.DecodeString("0905010a0b010361090001" + "0900")
+	cxt := NewDecoder(bytes.NewBuffer(blob), 3)
+
+	if token, err := cxt.Next(); err != nil || token.Kind != ArrayStart {
+		t.Fatalf("Expected ArrayStart, got %v (%v)", token.Kind, err)
+	}
+	for _, expected := range []string{"map[a:<nil>]", "<nil>"} {
+		value, err := cxt.DecodeNext()
+		if err != nil {
+			t.Fatalf("DecodeNext returned error: %v", err)
+		}
+		if fmt.Sprintf("%v", value) != expected {
+			t.Errorf("DecodeNext returned %v, expected %s", value, expected)
+		}
+	}
+	if token, err := cxt.Next(); err != nil || token.Kind != ArrayEnd {
+		t.Errorf("Expected ArrayEnd, got %v (%v)", token.Kind, err)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	for _, blobStr := range []string{"09", "0903", "090301", "0a02", "0a0b01036101", "ff"} {
+		blob, _ := hex.DecodeString(blobStr)
+		cxt := NewDecoder(bytes.NewBuffer(blob), 3)
+		var err error
+		for err == nil {
+			_, err = cxt.Next()
+		}
+		if err == io.EOF {
+			t.Errorf("Expected decode error but got io.EOF, for blob: %s", blobStr)
+		}
+	}
+}
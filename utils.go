@@ -188,55 +188,35 @@ func getOptArgString(v interface{}) (str string, err error) {
 // 1-level objects array means, each object in the array has no *object* type element[s],
 // all elements of this object should be plain type like Integer, String, Number, Null, Date ...
 //
-// If response body is not array of 1-level objects, you may need to parse it manually
+// ParseRespBody is kept for compatibility: DecodeResponse decodes into typed Go
+// values, nested objects included.
 func ParseRespBody(b []byte) (body [][]map[string]string, err error) {
-	data := bytes.NewBuffer(b)
-	bundle, err := DecodeMessageBundle(data)
+	results, err := ReadResults(b)
 	if err != nil {
 		return
 	}
 
-	for i := 0; i < len(bundle.Messages); i++ {
-		var bodyElement []map[string]string
-
-		if obj, ok := bundle.Messages[i].Body.(AvmObject); !ok {
-			err = errors.New(fmt.Sprintf("convert body to AvmObject: %d", i))
-		} else {
-			if elements, ok := obj.StaticFields["body"].([]interface{}); !ok {
-				err = errors.New(fmt.Sprintf("convert body field to array: %d", i))
-			} else {
-				for _, e := range elements {
-					m, err := parseElement(e)
-					if err != nil {
-						fmt.Printf("parseElement:%s\n", err.Error())
-					} else {
-						bodyElement = append(bodyElement, m)
-					}
-				}
-			}
+	for i, result := range results {
+		var elements []map[string]interface{}
+		if err = result.Decode(&elements); err != nil {
+			err = errors.New(fmt.Sprintf("decode body %d: %v", i, err))
+			return
+		}
 
-			if err != nil {
-				return
+		var bodyElement []map[string]string
+		for _, e := range elements {
+			m := make(map[string]string, len(e))
+			for k, v := range e {
+				m[k] = toString(v)
 			}
-			body = append(body, bodyElement)
+			bodyElement = append(bodyElement, m)
 		}
+		body = append(body, bodyElement)
 	}
 
 	return
 }
 
-func parseElement(obj interface{}) (m map[string]string, err error) {
-	if obj, ok := obj.(AvmObject); !ok {
-		err = errors.New("element to map")
-	} else {
-		m = make(map[string]string)
-		for k, v := range obj.StaticFields {
-			m[k] = toString(v)
-		}
-	}
-	return
-}
-
 func toString(v interface{}) string {
 	if v == nil {
 		return ""